@@ -3,6 +3,9 @@ let webSocket = null;
 let open = null;
 let authToken = null;
 let guid = null;
+// Messages sent but not acknowledged yet, by request ID. They're resent with the same client message ID
+// whenever the connection opens again, so that the server saves each of them once.
+let pending = new Map();
 // var token = '1';
 
 async function login(e) {
@@ -95,6 +98,8 @@ String.prototype.paddingRight = function (paddingLength) {
 let onopen = event => {
     open = true;
     console.log('Opening connection');
+    for (const frame of pending.values())
+        webSocket.send(JSON.stringify(frame));
 };
 
 let onmessage = event => {
@@ -102,6 +107,12 @@ let onmessage = event => {
     console.log(JSON.parse(event.data));
 
     let newMessages = JSON.parse(event.data)
+    if (newMessages.ack) {
+        // Only an internal failure is worth retrying, any other rejection would repeat.
+        if (newMessages.ack.ok || newMessages.ack.reason !== 'internal')
+            pending.delete(newMessages.ack.requestId);
+        return;
+    }
     newMessages = Array.isArray(newMessages) ? newMessages : [newMessages]
     messages = newMessages.concat(messages);
 
@@ -148,11 +159,15 @@ window.onload = () => {
         e.preventDefault();
         if (webSocket) {
             const inputs = document.getElementById("message-form").elements;
-            const message = {
-                "text": inputs["message"].value
+            const id = Date.now().toString(36) + Math.random().toString(36).substring(2);
+            const frame = {
+                "requestId": id,
+                "messages": [{"text": inputs["message"].value, "clientMsgId": id}]
             };
             inputs["message"].value = "";
-            webSocket.send(JSON.stringify(message));
+            pending.set(id, frame);
+            if (open)
+                webSocket.send(JSON.stringify(frame));
         } else {
             console.error("Socket connection is closed...");
         }
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"context"
 	"github.com/joho/godotenv"
 	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/config"
 	"gitlab.starlink.ua/high-school-prod/chat/server/seshandler"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 // Loads values from .env into the system
@@ -25,9 +30,59 @@ func main() {
 	// Handle url pattern "/chat" with "handler" function
 	http.HandleFunc("/chat", sh.Handle)
 
+	// Handle the fallbacks of "/chat" for clients that can't use WebSocket: a Server-Sent Events stream
+	// or long polling to receive, and posting to send
+	http.HandleFunc("/chat/stream", sh.HandleStream)
+	http.HandleFunc("/chat/poll", sh.HandlePoll)
+	http.HandleFunc("/chat/send", sh.HandleSend)
+
+	// Handle url pattern "/admin/audit" with the audit log query API
+	http.HandleFunc("/admin/audit", sh.HandleAudit)
+
+	// Handle url patterns "/chats" and "/chats/..." with the chat management API
+	http.HandleFunc("/chats", sh.HandleChats)
+	http.HandleFunc("/chats/", sh.HandleChats)
+
+	// Handle url patterns "/mentions" and "/mentions/..." with the unread mentions API
+	http.HandleFunc("/mentions", sh.HandleMentions)
+	http.HandleFunc("/mentions/", sh.HandleMentions)
+
 	chatRoot, _ := os.LookupEnv("SOCKET")
+	server := &http.Server{Addr: chatRoot}
+
+	go func() {
+		log.Logger.Infof("Listening and serving on %s", chatRoot)
+		// Log an error if the server failed to start
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Logger.Fatal(err)
+		}
+	}()
+
+	// Shut down gracefully on SIGTERM or SIGINT, within SHUTDOWN_TIMEOUT
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	log.Logger.Infof("Received %s, shutting down", <-stop)
 
-	log.Logger.Infof("Listening and serving on %s", chatRoot)
-	// Log an error if the server failed to start
-	log.Logger.Fatal(http.ListenAndServe(chatRoot, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), config.Duration("SHUTDOWN_TIMEOUT", 25*time.Second))
+	defer cancel()
+
+	// Tell the clients to reconnect elsewhere, then let the rest of the requests finish
+	drained := true
+	if err := sh.Drain(ctx); err != nil {
+		log.Logger.Warnf("Not all clients left in time - %s", err)
+		drained = false
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Logger.Warnf("Not all requests finished in time - %s", err)
+		drained = false
+	}
+
+	// Flush the pending audit records and close the DB, unless it's still in use by the clients and requests
+	// left over, which would fail on a closed DB. The connections are closed with the process then
+	if drained {
+		sh.Close()
+	} else {
+		sh.Flush()
+	}
+	log.Logger.Infof("Shut down")
 }
@@ -8,4 +8,5 @@ require (
 	github.com/lib/pq v1.9.0
 	github.com/sirupsen/logrus v1.7.0
 	github.com/t-tomalak/logrus-easy-formatter v0.0.0-20190827215021-c074f06c5816
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 )
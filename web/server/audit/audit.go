@@ -0,0 +1,251 @@
+// Package audit keeps an append-only log of security-relevant events.
+// Records are written asynchronously to the DB and, optionally, to a JSON lines file.
+package audit
+
+import (
+	"encoding/json"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/config"
+	"gitlab.starlink.ua/high-school-prod/chat/server/database"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types.
+const (
+	EventOriginRejected = "origin_rejected"
+	EventBadToken       = "bad_token"
+	EventBadGUID        = "bad_guid"
+	EventUpgradeFailed  = "upgrade_failed"
+	EventJoin           = "join"
+	EventLeave          = "leave"
+	EventMessageTooLong = "message_too_long"
+	EventChatCreated    = "chat_created"
+	EventChatUpdated    = "chat_updated"
+	EventMemberAdded    = "member_added"
+	EventMemberRemoved  = "member_removed"
+	EventRoleChanged    = "role_changed"
+	EventMemberMuted    = "member_muted"
+	EventMemberUnmuted  = "member_unmuted"
+	EventMemberBanned   = "member_banned"
+	EventMemberUnbanned = "member_unbanned"
+	EventFlooding       = "flooding"
+)
+
+// Outcomes.
+const (
+	OutcomeAllowed = "allowed"
+	OutcomeDenied  = "denied"
+)
+
+// Sink - a destination for audit records.
+type Sink interface {
+	Write(record model.AuditRecord) error
+}
+
+// Auditor - fans audit records out to the configured sinks.
+// Records that don't fit into the queue of AUDIT_QUEUE_SIZE are dropped and counted, so that a slow sink
+// never stalls the requests being audited.
+type Auditor struct {
+	sinks   []Sink
+	records chan model.AuditRecord
+	dropped uint64
+	mu      sync.RWMutex
+	closed  bool
+	flushed chan struct{}
+}
+
+// New - will construct and return an Auditor writing to the DB and, if AUDIT_LOG_FILE is set, to that file.
+func New(db *database.Database) *Auditor {
+	sinks := []Sink{&dbSink{db: db}}
+
+	if path, exists := os.LookupEnv("AUDIT_LOG_FILE"); exists && path != "" {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Logger.Fatalf("Couldn't open the audit log file - %s", err)
+		}
+		sinks = append(sinks, &fileSink{file: file})
+		log.Logger.Infof("Writing audit records to %s", path)
+	}
+
+	return NewWithSinks(sinks...)
+}
+
+// NewWithSinks - will construct and return an Auditor writing to the sinks.
+func NewWithSinks(sinks ...Sink) *Auditor {
+	auditor := &Auditor{
+		sinks:   sinks,
+		records: make(chan model.AuditRecord, config.Int("AUDIT_QUEUE_SIZE", 256)),
+		flushed: make(chan struct{}),
+	}
+	go auditor.auditHandler()
+
+	return auditor
+}
+
+// Record - will stamp the record and queue it for writing. A nil Auditor discards records.
+func (a *Auditor) Record(record model.AuditRecord) {
+	if a == nil {
+		return
+	}
+	if record.Timestamp.IsZero() {
+		record.Timestamp = time.Now().UTC()
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		log.Logger.Warnf("Auditor is closed, dropping audit record [%s]", record)
+		return
+	}
+	select {
+	case a.records <- record:
+	default:
+		dropped := atomic.AddUint64(&a.dropped, 1)
+		log.Logger.Warnf("Audit queue is full, dropping audit record [%s], %v dropped so far", record, dropped)
+	}
+}
+
+// Dropped - will return the number of records dropped because the queue was full.
+func (a *Auditor) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// Close - will write the records queued so far, close the sinks that can be closed and stop.
+// Records made afterwards are dropped.
+func (a *Auditor) Close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.records)
+	a.mu.Unlock()
+
+	<-a.flushed
+}
+
+// A go routine that monitors the records channel and writes every record to all sinks.
+func (a *Auditor) auditHandler() {
+	defer close(a.flushed)
+	for record := range a.records {
+		for _, sink := range a.sinks {
+			if err := sink.Write(record); err != nil {
+				log.Logger.Errorf("Couldn't write audit record [%s] - %s", record, err)
+			}
+		}
+	}
+
+	for _, sink := range a.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				log.Logger.Errorf("Couldn't close audit sink - %s", err)
+			}
+		}
+	}
+}
+
+// dbSink - writes audit records to the audit log table.
+type dbSink struct {
+	db *database.Database
+}
+
+// Write - will insert the record into the DB.
+func (s *dbSink) Write(record model.AuditRecord) error {
+	return s.db.WriteAuditRecord(record)
+}
+
+// fileSink - writes audit records to a file as JSON lines.
+type fileSink struct {
+	file *os.File
+}
+
+// Write - will append the record to the file as a single JSON line.
+func (s *fileSink) Write(record model.AuditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close - will close the file.
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+// ClientIP - will return the IP address of the request's client.
+// X-Forwarded-For is only trusted if the request comes from one of TRUSTED_PROXIES, a comma separated list of IPs
+// and CIDRs. The address is then the last forwarded one that isn't a trusted proxy, since the ones before it
+// could have been made up by the client.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	proxies := trustedProxies()
+	if !trusted(proxies, host) {
+		return host
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" || net.ParseIP(ip) == nil {
+			break
+		}
+		host = ip
+		if !trusted(proxies, ip) {
+			break
+		}
+	}
+	return host
+}
+
+// trustedProxies - will parse TRUSTED_PROXIES into networks, skipping malformed entries.
+func trustedProxies() []*net.IPNet {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(config.String("TRUSTED_PROXIES", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Logger.Warnf("Malformed trusted proxy [%s], skipping it", entry)
+			continue
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+// trusted - will check whether the IP belongs to one of the trusted proxies.
+func trusted(proxies []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range proxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package audit
+
+import (
+	"bufio"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.Logger.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// blockingSink - a sink that doesn't write until it's released.
+type blockingSink struct {
+	release chan struct{}
+	mu      sync.Mutex
+	written int
+}
+
+func (s *blockingSink) Write(record model.AuditRecord) error {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written++
+	return nil
+}
+
+func TestClientIP(t *testing.T) {
+	os.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1, malformed")
+	defer os.Unsetenv("TRUSTED_PROXIES")
+
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"203.0.113.7:4000", "", "203.0.113.7"},
+		{"203.0.113.7:4000", "198.51.100.1", "203.0.113.7"},
+		{"10.1.2.3:4000", "", "10.1.2.3"},
+		{"10.1.2.3:4000", "198.51.100.1", "198.51.100.1"},
+		{"10.1.2.3:4000", "1.1.1.1, 198.51.100.1", "198.51.100.1"},
+		{"10.1.2.3:4000", "198.51.100.1, 192.168.1.1", "198.51.100.1"},
+		{"192.168.1.1:4000", "10.0.0.1, 10.0.0.2", "10.0.0.1"},
+		{"10.1.2.3:4000", "not-an-ip", "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/chat", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := ClientIP(r); got != tt.want {
+			t.Errorf("Got %s from %s forwarding %q, want %s", got, tt.remoteAddr, tt.forwarded, tt.want)
+		}
+	}
+}
+
+// TestRecordDropsWhenFull - a full queue drops records instead of blocking the caller.
+func TestRecordDropsWhenFull(t *testing.T) {
+	os.Setenv("AUDIT_QUEUE_SIZE", "2")
+	defer os.Unsetenv("AUDIT_QUEUE_SIZE")
+
+	sink := &blockingSink{release: make(chan struct{})}
+	auditor := NewWithSinks(sink)
+
+	recorded := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			auditor.Record(model.AuditRecord{Event: EventBadToken})
+		}
+		close(recorded)
+	}()
+	select {
+	case <-recorded:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Record blocked on a full queue")
+	}
+
+	// One record is being written, two are queued and the rest are dropped.
+	if dropped := auditor.Dropped(); dropped < 7 {
+		t.Errorf("Dropped %v records, want at least 7", dropped)
+	}
+	close(sink.release)
+	auditor.Close()
+	if written := uint64(sink.written); written+auditor.Dropped() != 10 {
+		t.Errorf("Wrote %v and dropped %v records, want 10 in total", written, auditor.Dropped())
+	}
+}
+
+// TestCloseClosesFileSink - records queued before Close are written and the file is closed.
+func TestCloseClosesFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("Error when creating a directory %v, want none", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := os.Create(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatalf("Error when creating a file %v, want none", err)
+	}
+	auditor := NewWithSinks(&fileSink{file: file})
+	auditor.Record(model.AuditRecord{Event: EventJoin})
+	auditor.Record(model.AuditRecord{Event: EventLeave})
+	auditor.Close()
+
+	// Records made after Close are dropped.
+	auditor.Record(model.AuditRecord{Event: EventJoin})
+
+	if _, err := file.Write([]byte("x")); err == nil {
+		t.Errorf("No error when writing to the file after Close, want it closed")
+	}
+
+	written, err := os.Open(file.Name())
+	if err != nil {
+		t.Fatalf("Error when opening the file %v, want none", err)
+	}
+	defer written.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(written); scanner.Scan(); {
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("Wrote %v records, want 2", lines)
+	}
+}
@@ -0,0 +1,61 @@
+// Package config reads optional settings from the environment.
+// Values are looked up on every call, since .env is only loaded once the program starts.
+package config
+
+import (
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"os"
+	"strconv"
+	"time"
+)
+
+// String - will return the value of the environment variable, or def if it's not set.
+func String(name, def string) string {
+	value, exists := os.LookupEnv(name)
+	if !exists || value == "" {
+		return def
+	}
+	return value
+}
+
+// Int - will return the environment variable parsed as an integer, or def if it's not set or malformed.
+func Int(name string, def int) int {
+	value, exists := os.LookupEnv(name)
+	if !exists || value == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Logger.Warnf("Malformed %s [%s], using default [%v]", name, value, def)
+		return def
+	}
+	return parsed
+}
+
+// Duration - will return the environment variable parsed as a duration (e.g. "30s"), or def if it's not set or malformed.
+func Duration(name string, def time.Duration) time.Duration {
+	value, exists := os.LookupEnv(name)
+	if !exists || value == "" {
+		return def
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Logger.Warnf("Malformed %s [%s], using default [%v]", name, value, def)
+		return def
+	}
+	return parsed
+}
+
+// Float - will return the environment variable parsed as a floating point number, or def if it's not set or malformed.
+func Float(name string, def float64) float64 {
+	value, exists := os.LookupEnv(name)
+	if !exists || value == "" {
+		return def
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Logger.Warnf("Malformed %s [%s], using default [%v]", name, value, def)
+		return def
+	}
+	return parsed
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"fmt"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"strings"
+)
+
+// WriteAuditRecord - will append an audit record to the audit log table.
+func (db *Database) WriteAuditRecord(record model.AuditRecord) error {
+	_, err := db.psql.Exec(`INSERT INTO audit_log(timestamp, event, actor_id, chat_guid, ip, outcome, details)
+								   VALUES($1, $2, $3, $4, $5, $6, $7)`,
+		record.Timestamp, record.Event, record.ActorID, record.ChatGUID, record.IP, record.Outcome, record.Details)
+	return err
+}
+
+// ReadAuditRecords - will read audit records matching the filter, newest first.
+func (db *Database) ReadAuditRecords(filter model.AuditFilter) ([]model.AuditRecord, error) {
+	var (
+		conditions = make([]string, 0)
+		args       = make([]interface{}, 0)
+	)
+
+	// addCondition - appends a condition with a single positional argument.
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.ActorID != "" {
+		addCondition("actor_id = $%d", filter.ActorID)
+	}
+	if filter.ChatGUID != "" {
+		addCondition("chat_guid = $%d", filter.ChatGUID)
+	}
+	if filter.Event != "" {
+		addCondition("event = $%d", filter.Event)
+	}
+	if filter.Outcome != "" {
+		addCondition("outcome = $%d", filter.Outcome)
+	}
+	if filter.IP != "" {
+		addCondition("ip = $%d", filter.IP)
+	}
+	if !filter.Since.IsZero() {
+		addCondition("timestamp >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		addCondition("timestamp < $%d", filter.Until)
+	}
+	if filter.BeforeID > 0 {
+		addCondition("id < $%d", filter.BeforeID)
+	}
+
+	query := "SELECT id, timestamp, event, actor_id, chat_guid, ip, outcome, details FROM audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := db.psql.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]model.AuditRecord, 0)
+	for rows.Next() {
+		var record model.AuditRecord
+		err := rows.Scan(&record.ID, &record.Timestamp, &record.Event, &record.ActorID,
+			&record.ChatGUID, &record.IP, &record.Outcome, &record.Details)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
@@ -0,0 +1,321 @@
+package database
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"time"
+)
+
+// Errors returned by the chat management methods.
+var (
+	// ErrNotFound - returned when the requested entity doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrBanned - returned when adding a user who is banned from the chat.
+	ErrBanned = errors.New("banned")
+)
+
+// newGUID - generates a random (version 4) UUID.
+func newGUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// CreateChat - will create a new chat with the creator as its first member and owner.
+func (db *Database) CreateChat(title, creatorID string) (chat model.Chat, err error) {
+	guid, err := newGUID()
+	if err != nil {
+		return chat, err
+	}
+
+	tx, err := db.psql.Begin()
+	if err != nil {
+		return chat, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	chat = model.Chat{
+		GUID:      guid,
+		Kind:      model.ChatKindGroup,
+		Title:     title,
+		CreatedBy: creatorID,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err = tx.Exec("INSERT INTO chats(guid, title, created_by, created_at) VALUES($1, $2, $3, $4)",
+		chat.GUID, chat.Title, chat.CreatedBy, chat.CreatedAt)
+	if err != nil {
+		return chat, err
+	}
+	_, err = tx.Exec("INSERT INTO chats_users(user_id, chat_guid, role) VALUES($1, $2, $3)", creatorID, guid, model.RoleOwner)
+	if err != nil {
+		return chat, err
+	}
+
+	return chat, tx.Commit()
+}
+
+// ReadChat - will read the chat with the given GUID.
+// Chats that predate the chats table only exist in chats_users and are returned without a title.
+func (db *Database) ReadChat(guid string) (chat model.Chat, err error) {
+	err = db.psql.QueryRow(`SELECT c.guid, c.kind, c.title, c.topic, c.description, c.avatar, c.created_by, c.created_at
+								   FROM chats c WHERE c.guid=$1`, guid).
+		Scan(&chat.GUID, &chat.Kind, &chat.Title, &chat.Topic, &chat.Description, &chat.Avatar, &chat.CreatedBy, &chat.CreatedAt)
+	if err == sql.ErrNoRows {
+		var members int
+		if err := db.psql.QueryRow("SELECT COUNT(*) FROM chats_users WHERE chat_guid=$1", guid).Scan(&members); err != nil {
+			return chat, err
+		}
+		if members == 0 {
+			return chat, ErrNotFound
+		}
+		return model.Chat{GUID: guid, Kind: model.ChatKindGroup}, nil
+	}
+	return chat, err
+}
+
+// UpdateChat - will set the title, the topic, the description and the avatar of the chat.
+func (db *Database) UpdateChat(chat model.Chat) error {
+	_, err := db.psql.Exec(`INSERT INTO chats(guid, title, topic, description, avatar) VALUES($1, $2, $3, $4, $5)
+								   ON CONFLICT (guid) DO UPDATE SET title = EXCLUDED.title, topic = EXCLUDED.topic,
+								   	description = EXCLUDED.description, avatar = EXCLUDED.avatar`,
+		chat.GUID, chat.Title, chat.Topic, chat.Description, chat.Avatar)
+	return err
+}
+
+// SetChatTopic - will set the topic of the chat.
+func (db *Database) SetChatTopic(guid, topic string) error {
+	_, err := db.psql.Exec(`INSERT INTO chats(guid, topic) VALUES($1, $2)
+								   ON CONFLICT (guid) DO UPDATE SET topic = EXCLUDED.topic`, guid, topic)
+	return err
+}
+
+// ReadNickname - will read the nickname the member goes by in the chat, empty if the member has none.
+func (db *Database) ReadNickname(guid, userID string) (nickname string, err error) {
+	err = db.psql.QueryRow("SELECT nickname FROM chats_users WHERE chat_guid=$1 AND user_id=$2", guid, userID).Scan(&nickname)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return nickname, err
+}
+
+// SetNickname - will set the nickname the member goes by in the chat. An empty nickname resets it to the username.
+func (db *Database) SetNickname(guid, userID, nickname string) error {
+	_, err := db.psql.Exec("UPDATE chats_users SET nickname=$3 WHERE chat_guid=$1 AND user_id=$2", guid, userID, nickname)
+	return err
+}
+
+// ReadUserChats - will read all chats the user is a member of.
+func (db *Database) ReadUserChats(userID string) ([]model.Chat, error) {
+	rows, err := db.psql.Query(`SELECT cu.chat_guid, COALESCE(c.kind, 'group'), COALESCE(c.title, ''), COALESCE(c.created_by, ''), COALESCE(c.created_at, 'epoch')
+									   FROM chats_users cu
+									   	LEFT JOIN chats c ON c.guid = cu.chat_guid::text
+									   WHERE cu.user_id=$1
+									   ORDER BY c.created_at DESC NULLS LAST`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := make([]model.Chat, 0)
+	for rows.Next() {
+		var chat model.Chat
+		if err := rows.Scan(&chat.GUID, &chat.Kind, &chat.Title, &chat.CreatedBy, &chat.CreatedAt); err != nil {
+			return nil, err
+		}
+		chats = append(chats, chat)
+	}
+
+	return chats, rows.Err()
+}
+
+// directKey - will return the key identifying the direct chat between the two users, regardless of their order.
+func directKey(userID, peerID string) string {
+	if peerID < userID {
+		userID, peerID = peerID, userID
+	}
+	return userID + ":" + peerID
+}
+
+// DirectChat - will read the direct chat between the user and the peer, creating it if it doesn't exist yet.
+// Returns true if the chat was created.
+func (db *Database) DirectChat(userID, peerID string) (chat model.Chat, created bool, err error) {
+	key := directKey(userID, peerID)
+	chat, err = db.readDirectChat(key)
+	if err != ErrNotFound {
+		return chat, false, err
+	}
+
+	guid, err := newGUID()
+	if err != nil {
+		return chat, false, err
+	}
+
+	tx, err := db.psql.Begin()
+	if err != nil {
+		return chat, false, err
+	}
+	defer func() {
+		if err != nil || !created {
+			_ = tx.Rollback()
+		}
+	}()
+
+	chat = model.Chat{
+		GUID:      guid,
+		Kind:      model.ChatKindDirect,
+		CreatedBy: userID,
+		CreatedAt: time.Now().UTC(),
+	}
+	result, err := tx.Exec(`INSERT INTO chats(guid, kind, direct_key, created_by, created_at) VALUES($1, $2, $3, $4, $5)
+								   ON CONFLICT (direct_key) WHERE direct_key IS NOT NULL DO NOTHING`,
+		chat.GUID, chat.Kind, key, chat.CreatedBy, chat.CreatedAt)
+	if err != nil {
+		return chat, false, err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		// The other user has created the chat concurrently.
+		_ = tx.Rollback()
+		if err != nil {
+			return chat, false, err
+		}
+		chat, err = db.readDirectChat(key)
+		return chat, false, err
+	}
+	for _, member := range []string{userID, peerID} {
+		if _, err = tx.Exec("INSERT INTO chats_users(user_id, chat_guid) VALUES($1, $2)", member, guid); err != nil {
+			return chat, false, err
+		}
+	}
+
+	created = true
+	return chat, created, tx.Commit()
+}
+
+// readDirectChat - will read the direct chat with the given key.
+func (db *Database) readDirectChat(key string) (chat model.Chat, err error) {
+	err = db.psql.QueryRow(`SELECT guid, kind, title, created_by, created_at FROM chats WHERE direct_key=$1`, key).
+		Scan(&chat.GUID, &chat.Kind, &chat.Title, &chat.CreatedBy, &chat.CreatedAt)
+	if err == sql.ErrNoRows {
+		return chat, ErrNotFound
+	}
+	return chat, err
+}
+
+// ReadUserDirectChats - will read all direct chats of the user, each with the other member as its peer.
+func (db *Database) ReadUserDirectChats(userID string) ([]model.Chat, error) {
+	rows, err := db.psql.Query(`SELECT c.guid, c.kind, c.title, c.created_by, c.created_at, u.id, u.username
+									   FROM chats c
+									   	INNER JOIN chats_users me ON me.chat_guid::text = c.guid AND me.user_id=$1
+									   	INNER JOIN chats_users peer ON peer.chat_guid::text = c.guid AND peer.user_id<>$1
+									   	INNER JOIN users u ON u.id = peer.user_id
+									   WHERE c.kind=$2
+									   ORDER BY c.created_at DESC`, userID, model.ChatKindDirect)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := make([]model.Chat, 0)
+	for rows.Next() {
+		var chat model.Chat
+		var peer model.Client
+		if err := rows.Scan(&chat.GUID, &chat.Kind, &chat.Title, &chat.CreatedBy, &chat.CreatedAt, &peer.UserID, &peer.Username); err != nil {
+			return nil, err
+		}
+		chat.Peer = &peer
+		chats = append(chats, chat)
+	}
+
+	return chats, rows.Err()
+}
+
+// ReadUser - will read the user with the given ID.
+func (db *Database) ReadUser(userID string) (user model.Client, err error) {
+	err = db.psql.QueryRow("SELECT id, username FROM users WHERE id=$1", userID).Scan(&user.UserID, &user.Username)
+	if err == sql.ErrNoRows {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+// ReadChatMembers - will read all members of the chat, with their nicknames and roles.
+func (db *Database) ReadChatMembers(guid string) ([]model.Member, error) {
+	rows, err := db.psql.Query(`SELECT u.id, u.username, cu.nickname, cu.role, cu.muted_until
+									   FROM chats_users cu
+									   	INNER JOIN users u ON u.id = cu.user_id
+									   WHERE cu.chat_guid=$1
+									   ORDER BY u.username`, guid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]model.Member, 0)
+	for rows.Next() {
+		var member model.Member
+		var mutedUntil sql.NullTime
+		if err := rows.Scan(&member.UserID, &member.Username, &member.Nickname, &member.Role, &mutedUntil); err != nil {
+			return nil, err
+		}
+		if mutedUntil.Valid {
+			member.MutedUntil = &mutedUntil.Time
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+// AddChatMember - will add the user to the chat. Returns false if the user was already a member,
+// and ErrBanned if the user is banned from the chat.
+func (db *Database) AddChatMember(guid, userID string) (added bool, err error) {
+	tx, err := db.psql.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil || !added {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var matches int
+	err = tx.QueryRow("SELECT COUNT(*) FROM chats_users WHERE user_id=$1 AND chat_guid=$2", userID, guid).Scan(&matches)
+	if err != nil || matches > 0 {
+		return false, err
+	}
+	err = tx.QueryRow("SELECT COUNT(*) FROM chat_bans WHERE user_id=$1 AND chat_guid=$2", userID, guid).Scan(&matches)
+	if err != nil {
+		return false, err
+	}
+	if matches > 0 {
+		return false, ErrBanned
+	}
+	if _, err = tx.Exec("INSERT INTO chats_users(user_id, chat_guid) VALUES($1, $2)", userID, guid); err != nil {
+		return false, err
+	}
+
+	added = true
+	return added, tx.Commit()
+}
+
+// RemoveChatMember - will remove the user from the chat. Returns false if the user wasn't a member.
+func (db *Database) RemoveChatMember(guid, userID string) (bool, error) {
+	result, err := db.psql.Exec("DELETE FROM chats_users WHERE user_id=$1 AND chat_guid=$2", userID, guid)
+	if err != nil {
+		return false, err
+	}
+	removed, err := result.RowsAffected()
+	return removed > 0, err
+}
@@ -0,0 +1,21 @@
+package database
+
+import "testing"
+
+func TestDirectKey(t *testing.T) {
+	tests := []struct {
+		userID, peerID string
+		want           string
+	}{
+		{"1", "2", "1:2"},
+		{"2", "1", "1:2"},
+		{"10", "9", "10:9"},
+		{"9", "10", "10:9"},
+	}
+
+	for _, tt := range tests {
+		if got := directKey(tt.userID, tt.peerID); got != tt.want {
+			t.Errorf("Got key %s for %s and %s, want %s", got, tt.userID, tt.peerID, tt.want)
+		}
+	}
+}
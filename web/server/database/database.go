@@ -15,17 +15,15 @@ import (
 
 // Database - an abstraction for DB interaction.
 type Database struct {
-	psql    *sql.DB
-	MsgChan chan model.Message
+	psql *sql.DB
 }
 
 // New - will construct and return a Database instance.
 func New() *Database {
 	db := &Database{
-		psql:    establishConnection(),
-		MsgChan: make(chan model.Message),
+		psql: establishConnection(),
 	}
-	go db.databaseHandler()
+	db.migrate()
 	log.Logger.Infof("Created a new Database instance")
 	return db
 }
@@ -47,6 +45,7 @@ func establishConnection() *sql.DB {
 }
 
 // ReadRecentMessages - will read recent messages from the db and return as a slice.
+// HasMore of the returned payload tells whether there are even older messages than the ones read.
 func (db *Database) ReadRecentMessages(guid string, numMsgs int, pageToken string) (payload model.Payload) {
 	var (
 		msgs *sql.Rows
@@ -54,9 +53,11 @@ func (db *Database) ReadRecentMessages(guid string, numMsgs int, pageToken strin
 	)
 
 	// Read last numMsgs messages from the DB.
-	stmt, err := db.psql.Prepare(`SELECT m.id, user_id, username, text, timestamp, chat_guid 
+	stmt, err := db.psql.Prepare(`SELECT m.id, m.user_id, COALESCE(NULLIF(cu.nickname, ''), u.username), m.text, m.timestamp, m.chat_guid,
+										 	COALESCE(m.client_msg_id, ''), COALESCE(m.seq, 0), m.kind
 										 FROM messages m 
    										 	INNER JOIN users u ON u.id = m.user_id 
+										 	LEFT JOIN chats_users cu ON cu.chat_guid::text = m.chat_guid::text AND cu.user_id = m.user_id
 										 WHERE m.chat_guid=$1 
 										 AND m.id < $3
 										 ORDER BY m.timestamp DESC
@@ -69,10 +70,11 @@ func (db *Database) ReadRecentMessages(guid string, numMsgs int, pageToken strin
 	// If it's not - select messages, which ids are lesser that an arbitrary big number.
 	msgID := decrypt(pageToken)
 	log.Logger.Infof("Decrypted page token %s into message ID %s", pageToken, msgID)
+	// One message more than requested is read to find out whether there are older messages.
 	if msgID != "" {
-		msgs, err = stmt.Query(guid, numMsgs, msgID)
+		msgs, err = stmt.Query(guid, numMsgs+1, msgID)
 	} else {
-		msgs, err = stmt.Query(guid, numMsgs, strconv.Itoa(math.MaxInt32))
+		msgs, err = stmt.Query(guid, numMsgs+1, strconv.Itoa(math.MaxInt32))
 	}
 	if err != nil {
 		log.Logger.Fatalf("Error when querying SQL statement - %s", err)
@@ -89,25 +91,42 @@ func (db *Database) ReadRecentMessages(guid string, numMsgs int, pageToken strin
 	var (
 		lastMsgs  = make([]model.Message, 0)
 		lastMsgID string
+		hasMore   bool
 	)
 
 	// Iterate over queried data, scan it into the variables and append to the destination string.
 	for msgs.Next() {
 		// Declaring variables to describe types of queried data.
 		var (
-			msgID     string
-			userID    string
-			userName  string
-			timestamp string
-			text      string
-			chatGUID  string
+			msgID       string
+			userID      string
+			userName    string
+			timestamp   string
+			text        string
+			chatGUID    string
+			clientMsgID string
+			seq         int64
+			kind        string
 		)
 
-		err := msgs.Scan(&msgID, &userID, &userName, &text, &timestamp, &chatGUID)
+		err := msgs.Scan(&msgID, &userID, &userName, &text, &timestamp, &chatGUID, &clientMsgID, &seq, &kind)
 		if err != nil {
 			log.Logger.Fatal(err)
 		}
-		lastMsgs = append(lastMsgs, model.Message{userID, userName, timestamp, text, chatGUID})
+		if len(lastMsgs) == numMsgs {
+			hasMore = true
+			break
+		}
+		lastMsgs = append(lastMsgs, model.Message{
+			UserID:      userID,
+			Username:    userName,
+			Timestamp:   timestamp,
+			Text:        text,
+			ChatGUID:    chatGUID,
+			ClientMsgID: clientMsgID,
+			Seq:         seq,
+			Kind:        kind,
+		})
 		lastMsgID = msgID
 	}
 	log.Logger.Infof("Fetched %v messages", len(lastMsgs))
@@ -128,14 +147,20 @@ func (db *Database) ReadRecentMessages(guid string, numMsgs int, pageToken strin
 	payload = model.Payload{
 		Messages:  lastMsgs,
 		PageToken: newPageToken,
+		PageSize:  numMsgs,
+		HasMore:   hasMore,
 	}
 
 	return payload
 }
 
 // ValidateUserChat - will validate that the chatGUID exists in the db and that the userID has access to the guid.
+// Users banned from the chat have no access to it.
 func (db *Database) ValidateUserChat(userID, chatGUID string) bool {
-	stmt, err := db.psql.Prepare("SELECT COUNT(*) FROM chats_users WHERE user_id=$1 AND chat_guid=$2")
+	stmt, err := db.psql.Prepare(`SELECT COUNT(*) FROM chats_users cu
+										 WHERE cu.user_id=$1 AND cu.chat_guid=$2
+										 AND NOT EXISTS (SELECT 1 FROM chat_bans b
+										 	WHERE b.chat_guid = cu.chat_guid::text AND b.user_id = cu.user_id::text)`)
 	if err != nil {
 		log.Logger.Fatal(err)
 	}
@@ -160,21 +185,115 @@ func (db *Database) ValidateUserChat(userID, chatGUID string) bool {
 	return matches > 0
 }
 
-// A go routine that monitors message channel and updates the database with new messages.
-func (db *Database) databaseHandler() {
-	for {
-		msg := <-db.MsgChan
+// SaveMessage - will insert the message into the DB, assigning it the next sequence number of its chat.
+// If the message carries a client message ID which was already saved for the same user and chat,
+// nothing is inserted and the previously saved message is returned with duplicate set to true.
+func (db *Database) SaveMessage(msg model.Message) (saved model.Message, duplicate bool, err error) {
+	if msg.ClientMsgID != "" {
+		if saved, err = db.readByClientMsgID(msg); err != sql.ErrNoRows {
+			return saved, err == nil, err
+		}
+	}
 
-		// Insert the message into the DB.
-		stmt, err := db.psql.Prepare("INSERT INTO messages(user_id, text, timestamp, chat_guid) VALUES($1, $2, $3, $4)")
-		if err != nil {
-			log.Logger.Fatal(err)
+	tx, err := db.psql.Begin()
+	if err != nil {
+		return msg, false, err
+	}
+	defer func() {
+		if err != nil || duplicate {
+			_ = tx.Rollback()
 		}
-		_, err = stmt.Exec(msg.UserID, msg.Text, msg.Timestamp, msg.ChatGUID)
+	}()
+
+	// Incrementing the chat's sequence locks its row until the transaction ends,
+	// so sequence numbers of a chat are assigned in the order the messages are saved.
+	err = tx.QueryRow(`INSERT INTO chat_sequences(chat_guid, last_seq) VALUES($1, 1)
+							  ON CONFLICT (chat_guid) DO UPDATE SET last_seq = chat_sequences.last_seq + 1
+							  RETURNING last_seq`, msg.ChatGUID).Scan(&msg.Seq)
+	if err != nil {
+		return msg, false, err
+	}
+
+	err = tx.QueryRow(`INSERT INTO messages(user_id, text, timestamp, chat_guid, client_msg_id, seq, kind)
+							  VALUES($1, $2, $3, $4, NULLIF($5, ''), $6, $7)
+							  ON CONFLICT (chat_guid, user_id, client_msg_id) WHERE client_msg_id IS NOT NULL DO NOTHING
+							  RETURNING id`,
+		msg.UserID, msg.Text, msg.Timestamp, msg.ChatGUID, msg.ClientMsgID, msg.Seq, msg.Kind).Scan(&msg.ID)
+	if err == sql.ErrNoRows {
+		// The same message was saved concurrently - give the sequence number back and read the original.
+		duplicate = true
+		saved, err = db.readByClientMsgID(msg)
+		return saved, duplicate, err
+	}
+	if err != nil {
+		return msg, false, err
+	}
+
+	return msg, false, tx.Commit()
+}
+
+// readByClientMsgID - will read the message previously saved with the same client message ID.
+func (db *Database) readByClientMsgID(msg model.Message) (saved model.Message, err error) {
+	saved = msg
+	err = db.psql.QueryRow(`SELECT id, text, timestamp, COALESCE(seq, 0), kind FROM messages
+								   WHERE chat_guid=$1 AND user_id=$2 AND client_msg_id=$3`,
+		msg.ChatGUID, msg.UserID, msg.ClientMsgID).Scan(&saved.ID, &saved.Text, &saved.Timestamp, &saved.Seq, &saved.Kind)
+	return saved, err
+}
+
+// ReadMessageRange - will read up to numMsgs messages of the chat with sequence numbers from fromSeq to toSeq inclusive.
+// The messages are returned newest first, like the other history pages; HasMore is set if the range didn't fit.
+func (db *Database) ReadMessageRange(guid string, fromSeq, toSeq int64, numMsgs int) (payload model.Payload, err error) {
+	rows, err := db.psql.Query(`SELECT m.user_id, COALESCE(NULLIF(cu.nickname, ''), u.username), m.text, m.timestamp, m.chat_guid,
+									   	COALESCE(m.client_msg_id, ''), m.seq, m.kind
+									   FROM messages m
+									   	INNER JOIN users u ON u.id = m.user_id
+									   	LEFT JOIN chats_users cu ON cu.chat_guid::text = m.chat_guid::text AND cu.user_id = m.user_id
+									   WHERE m.chat_guid=$1 AND m.seq BETWEEN $2 AND $3
+									   ORDER BY m.seq ASC
+									   LIMIT $4`, guid, fromSeq, toSeq, numMsgs+1)
+	if err != nil {
+		return payload, err
+	}
+	defer rows.Close()
+
+	msgs := make([]model.Message, 0)
+	for rows.Next() {
+		var msg model.Message
+		err := rows.Scan(&msg.UserID, &msg.Username, &msg.Text, &msg.Timestamp, &msg.ChatGUID, &msg.ClientMsgID, &msg.Seq, &msg.Kind)
 		if err != nil {
-			log.Logger.Fatal(err)
+			return payload, err
+		}
+		if len(msgs) == numMsgs {
+			payload.HasMore = true
+			break
 		}
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return payload, err
+	}
+
+	// Newest first.
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+
+	payload.Messages = msgs
+	payload.PageSize = numMsgs
+	payload.SeqFrom = fromSeq
+	payload.SeqTo = toSeq
+	if payload.HasMore {
+		payload.SeqTo = msgs[0].Seq
+	}
+
+	return payload, nil
+}
 
-		log.Logger.Infof("Successfully saved the message to the DB")
+// Close - will close the connection to the DB.
+func (db *Database) Close() {
+	if err := db.psql.Close(); err != nil {
+		log.Logger.Error(err)
 	}
+	log.Logger.Infof("Closed the DB connection")
 }
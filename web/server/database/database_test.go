@@ -39,13 +39,10 @@ func TestNew(t *testing.T) {
 		t.Errorf("Type is %T, want *database.Database", got)
 	}
 
-	// Check type of the 'sessGuid' and 'MsgChan' fields
+	// Check type of the 'psql' field
 	if fmt.Sprintf("%T", got.psql) != "*sql.DB" {
 		t.Errorf("Type is %T, want *sql.DB", got.psql)
 	}
-	if fmt.Sprintf("%T", got.MsgChan) != "chan model.Message" {
-		t.Errorf("Type is %T, want chan model.Message", got.MsgChan)
-	}
 }
 
 func TestReadRecentMessages(t *testing.T) {
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+)
+
+// SaveMentions - will record that the users were mentioned in the message, which must be saved already.
+func (db *Database) SaveMentions(msg model.Message, users []model.Client) (mentions []model.Mention, err error) {
+	tx, err := db.psql.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	mentions = make([]model.Mention, 0, len(users))
+	for _, user := range users {
+		mention := model.Mention{UserID: user.UserID, Message: msg}
+		err = tx.QueryRow("INSERT INTO mentions(user_id, message_id) VALUES($1, $2) RETURNING id", user.UserID, msg.ID).
+			Scan(&mention.ID)
+		if err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+
+	return mentions, tx.Commit()
+}
+
+// ReadUnreadMentions - will read up to limit mentions of the user that weren't marked as read, newest first.
+// Only mentions in the chats the user is still a member of are read, with their authors named as in the chat.
+func (db *Database) ReadUnreadMentions(userID string, limit int) ([]model.Mention, error) {
+	rows, err := db.psql.Query(`SELECT mn.id, mn.user_id, m.id, m.user_id, COALESCE(NULLIF(author.nickname, ''), u.username),
+									   	m.text, m.timestamp, m.chat_guid, COALESCE(m.seq, 0), m.kind
+									   FROM mentions mn
+									   	INNER JOIN messages m ON m.id = mn.message_id
+									   	INNER JOIN chats_users me ON me.chat_guid::text = m.chat_guid::text AND me.user_id::text = mn.user_id
+									   	INNER JOIN users u ON u.id = m.user_id
+									   	LEFT JOIN chats_users author ON author.chat_guid::text = m.chat_guid::text AND author.user_id = m.user_id
+									   WHERE mn.user_id=$1 AND mn.read_at IS NULL
+									   ORDER BY mn.id DESC
+									   LIMIT $2`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mentions := make([]model.Mention, 0)
+	for rows.Next() {
+		var mention model.Mention
+		msg := &mention.Message
+		err := rows.Scan(&mention.ID, &mention.UserID, &msg.ID, &msg.UserID, &msg.Username, &msg.Text, &msg.Timestamp, &msg.ChatGUID, &msg.Seq, &msg.Kind)
+		if err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+
+	return mentions, rows.Err()
+}
+
+// MarkMentionsRead - will mark the user's mentions up to and including the given ID as read.
+// Returns the number of mentions marked.
+func (db *Database) MarkMentionsRead(userID string, upToID int64) (int64, error) {
+	result, err := db.psql.Exec("UPDATE mentions SET read_at = now() WHERE user_id=$1 AND id<=$2 AND read_at IS NULL",
+		userID, upToID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"database/sql"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"time"
+)
+
+// ReadMember - will read the member of the chat with the member's nickname and role.
+func (db *Database) ReadMember(guid, userID string) (member model.Member, err error) {
+	var mutedUntil sql.NullTime
+	err = db.psql.QueryRow(`SELECT u.id, u.username, cu.nickname, cu.role, cu.muted_until
+								   FROM chats_users cu
+								   	INNER JOIN users u ON u.id = cu.user_id
+								   WHERE cu.chat_guid=$1 AND cu.user_id=$2`, guid, userID).
+		Scan(&member.UserID, &member.Username, &member.Nickname, &member.Role, &mutedUntil)
+	if err == sql.ErrNoRows {
+		return member, ErrNotFound
+	}
+	if mutedUntil.Valid {
+		member.MutedUntil = &mutedUntil.Time
+	}
+	return member, err
+}
+
+// SetMemberRole - will change the role of the member. Returns false if the user isn't a member.
+func (db *Database) SetMemberRole(guid, userID, role string) (bool, error) {
+	result, err := db.psql.Exec("UPDATE chats_users SET role=$3 WHERE chat_guid=$1 AND user_id=$2", guid, userID, role)
+	if err != nil {
+		return false, err
+	}
+	changed, err := result.RowsAffected()
+	return changed > 0, err
+}
+
+// MuteMember - will keep the member from posting until the time, or let the member post again if it's nil.
+// Returns false if the user isn't a member.
+func (db *Database) MuteMember(guid, userID string, until *time.Time) (bool, error) {
+	result, err := db.psql.Exec("UPDATE chats_users SET muted_until=$3 WHERE chat_guid=$1 AND user_id=$2", guid, userID, until)
+	if err != nil {
+		return false, err
+	}
+	muted, err := result.RowsAffected()
+	return muted > 0, err
+}
+
+// BanMember - will remove the user from the chat, if a member, and keep the user from being added again.
+func (db *Database) BanMember(guid string, ban model.Ban) (err error) {
+	tx, err := db.psql.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if _, err = tx.Exec("DELETE FROM chats_users WHERE chat_guid=$1 AND user_id=$2", guid, ban.UserID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO chat_bans(chat_guid, user_id, banned_by, reason) VALUES($1, $2, $3, $4)
+							 ON CONFLICT (chat_guid, user_id) DO UPDATE SET banned_by = EXCLUDED.banned_by, reason = EXCLUDED.reason`,
+		guid, ban.UserID, ban.BannedBy, ban.Reason)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UnbanMember - will let the user be added to the chat again. Returns false if the user wasn't banned.
+func (db *Database) UnbanMember(guid, userID string) (bool, error) {
+	result, err := db.psql.Exec("DELETE FROM chat_bans WHERE chat_guid=$1 AND user_id=$2", guid, userID)
+	if err != nil {
+		return false, err
+	}
+	unbanned, err := result.RowsAffected()
+	return unbanned > 0, err
+}
+
+// ReadChatBans - will read all bans of the chat, newest first.
+func (db *Database) ReadChatBans(guid string) ([]model.Ban, error) {
+	rows, err := db.psql.Query(`SELECT user_id, banned_by, reason, created_at FROM chat_bans
+									   WHERE chat_guid=$1
+									   ORDER BY created_at DESC`, guid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bans := make([]model.Ban, 0)
+	for rows.Next() {
+		var ban model.Ban
+		if err := rows.Scan(&ban.UserID, &ban.BannedBy, &ban.Reason, &ban.CreatedAt); err != nil {
+			return nil, err
+		}
+		bans = append(bans, ban)
+	}
+
+	return bans, rows.Err()
+}
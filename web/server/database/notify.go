@@ -0,0 +1,38 @@
+package database
+
+import (
+	"github.com/lib/pq"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"os"
+	"time"
+)
+
+// Notify - will publish the payload to every instance listening on the channel.
+func (db *Database) Notify(channel, payload string) error {
+	_, err := db.psql.Exec("SELECT pg_notify($1, $2)", channel, payload)
+	return err
+}
+
+// Listen - will call handle with the payload of every notification published on the channel.
+// Listening uses a dedicated connection, which is re-established if it breaks.
+func (db *Database) Listen(channel string, handle func(payload string)) {
+	dbSource, _ := os.LookupEnv("DB_SOURCE")
+	listener := pq.NewListener(dbSource, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Logger.Errorf("Listener of channel %s - %s", channel, err)
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		log.Logger.Fatalf("Couldn't listen to channel %s - %s", channel, err)
+	}
+	log.Logger.Infof("Listening to DB notifications on channel %s", channel)
+
+	go func() {
+		for notification := range listener.Notify {
+			// A nil notification means the connection was re-established - there's nothing to deliver.
+			if notification != nil {
+				handle(notification.Extra)
+			}
+		}
+	}()
+}
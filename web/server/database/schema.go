@@ -0,0 +1,90 @@
+package database
+
+import (
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+)
+
+// migrations - statements that bring the schema up to date. Every statement must be idempotent,
+// since they are all executed on each start of the application.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id         BIGSERIAL PRIMARY KEY,
+		timestamp  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		event      TEXT NOT NULL,
+		actor_id   TEXT NOT NULL DEFAULT '',
+		chat_guid  TEXT NOT NULL DEFAULT '',
+		ip         TEXT NOT NULL DEFAULT '',
+		outcome    TEXT NOT NULL DEFAULT '',
+		details    TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor_id, id)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_chat_idx ON audit_log (chat_guid, id)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_event_idx ON audit_log (event, id)`,
+	`CREATE TABLE IF NOT EXISTS chats (
+		guid        TEXT PRIMARY KEY,
+		title       TEXT NOT NULL DEFAULT '',
+		created_by  TEXT NOT NULL DEFAULT '',
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_msg_id TEXT`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS messages_client_msg_id_idx
+		ON messages (chat_guid, user_id, client_msg_id) WHERE client_msg_id IS NOT NULL`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS seq BIGINT`,
+	`CREATE TABLE IF NOT EXISTS chat_sequences (
+		chat_guid  TEXT PRIMARY KEY,
+		last_seq   BIGINT NOT NULL
+	)`,
+	// Number the messages saved without a sequence number, continuing each chat's sequence.
+	`UPDATE messages m SET seq = numbered.seq
+		FROM (SELECT n.id, COALESCE((SELECT MAX(s.seq) FROM messages s WHERE s.chat_guid = n.chat_guid), 0)
+					+ ROW_NUMBER() OVER (PARTITION BY n.chat_guid ORDER BY n.id) AS seq
+			  FROM messages n
+			  WHERE n.seq IS NULL) numbered
+		WHERE m.id = numbered.id`,
+	`INSERT INTO chat_sequences(chat_guid, last_seq)
+		SELECT chat_guid::text, MAX(seq) FROM messages WHERE seq IS NOT NULL GROUP BY chat_guid
+		ON CONFLICT (chat_guid) DO UPDATE SET last_seq = GREATEST(chat_sequences.last_seq, EXCLUDED.last_seq)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS messages_seq_idx ON messages (chat_guid, seq)`,
+	`ALTER TABLE chats ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'group'`,
+	// A direct chat is keyed by its members' IDs, so a pair of users can only ever have one.
+	`ALTER TABLE chats ADD COLUMN IF NOT EXISTS direct_key TEXT`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS chats_direct_key_idx ON chats (direct_key) WHERE direct_key IS NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS mentions (
+		id          BIGSERIAL PRIMARY KEY,
+		user_id     TEXT NOT NULL,
+		message_id  BIGINT NOT NULL,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		read_at     TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS mentions_unread_idx ON mentions (user_id, id) WHERE read_at IS NULL`,
+	`ALTER TABLE messages ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE chats ADD COLUMN IF NOT EXISTS topic TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE chats_users ADD COLUMN IF NOT EXISTS nickname TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE chats ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE chats ADD COLUMN IF NOT EXISTS avatar TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE chats_users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'member'`,
+	`ALTER TABLE chats_users ADD COLUMN IF NOT EXISTS muted_until TIMESTAMPTZ`,
+	// The creators of the chats that have no owner yet become their owners.
+	`UPDATE chats_users cu SET role = 'owner'
+		FROM chats c
+		WHERE c.guid = cu.chat_guid::text AND c.created_by = cu.user_id::text AND c.kind = 'group'
+			AND NOT EXISTS (SELECT 1 FROM chats_users o WHERE o.chat_guid = cu.chat_guid AND o.role = 'owner')`,
+	`CREATE TABLE IF NOT EXISTS chat_bans (
+		chat_guid   TEXT NOT NULL,
+		user_id     TEXT NOT NULL,
+		banned_by   TEXT NOT NULL DEFAULT '',
+		reason      TEXT NOT NULL DEFAULT '',
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (chat_guid, user_id)
+	)`,
+}
+
+// migrate - will apply the migrations to the DB.
+func (db *Database) migrate() {
+	for _, migration := range migrations {
+		if _, err := db.psql.Exec(migration); err != nil {
+			log.Logger.Fatalf("Error when migrating the DB schema - %s", err)
+		}
+	}
+	log.Logger.Infof("Migrated the DB schema")
+}
@@ -0,0 +1,127 @@
+// Package mentions delivers mentions of users to all of their connections, whichever chats those are attached to,
+// on this and on other instances.
+package mentions
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"sync"
+)
+
+// channel - the notification channel instances exchange mentions on.
+const channel = "mentions"
+
+// Bus - a way to exchange mentions with other instances, implemented by the database package.
+type Bus interface {
+	Notify(channel, payload string) error
+	Listen(channel string, handle func(payload string))
+}
+
+// busMessage - a mention published by one instance.
+type busMessage struct {
+	Instance string        `json:"instance"`
+	Mention  model.Mention `json:"mention"`
+}
+
+// Hub - delivers mentions to the subscribers of the mentioned users.
+// A nil Hub delivers nothing.
+type Hub struct {
+	instance    string
+	bus         Bus
+	mu          sync.Mutex
+	subscribers map[string]map[int]func(model.Mention)
+	nextID      int
+}
+
+// NewHub - will construct and return a Hub. If bus is not nil, mentions are shared with the other instances.
+func NewHub(bus Bus) *Hub {
+	instance := make([]byte, 8)
+	if _, err := rand.Read(instance); err != nil {
+		log.Logger.Fatal(err)
+	}
+
+	h := &Hub{
+		instance:    hex.EncodeToString(instance),
+		bus:         bus,
+		subscribers: make(map[string]map[int]func(model.Mention)),
+	}
+
+	if bus != nil {
+		bus.Listen(channel, h.receive)
+	}
+
+	return h
+}
+
+// Subscribe - will call notify with every mention of the user, until unsubscribed.
+func (h *Hub) Subscribe(userID string, notify func(model.Mention)) (unsubscribe func()) {
+	if h == nil {
+		return func() {}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[int]func(model.Mention))
+	}
+	id := h.nextID
+	h.nextID++
+	h.subscribers[userID][id] = notify
+
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers[userID], id)
+		if len(h.subscribers[userID]) == 0 {
+			delete(h.subscribers, userID)
+		}
+	}
+}
+
+// Publish - will deliver the mention to the mentioned user's subscribers on this and on the other instances.
+func (h *Hub) Publish(mention model.Mention) {
+	if h == nil {
+		return
+	}
+
+	h.deliver(mention)
+	if h.bus == nil {
+		return
+	}
+
+	payload, err := json.Marshal(busMessage{Instance: h.instance, Mention: mention})
+	if err != nil {
+		log.Logger.Error(err)
+		return
+	}
+	if err := h.bus.Notify(channel, string(payload)); err != nil {
+		log.Logger.Errorf("Couldn't publish the mention of user with id %s - %s", mention.UserID, err)
+	}
+}
+
+// deliver - will call the subscribers of the mentioned user on this instance.
+func (h *Hub) deliver(mention model.Mention) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, notify := range h.subscribers[mention.UserID] {
+		notify(mention)
+	}
+}
+
+// receive - will deliver the mention published by another instance.
+func (h *Hub) receive(payload string) {
+	var msg busMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		log.Logger.Errorf("Malformed mention notification - %s", err)
+		return
+	}
+	if msg.Instance == h.instance {
+		return
+	}
+	h.deliver(msg.Mention)
+}
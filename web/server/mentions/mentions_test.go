@@ -0,0 +1,73 @@
+package mentions
+
+import (
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.Logger.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeBus - a Bus looping notifications back to every listener, like the DB does.
+type fakeBus struct {
+	listeners []func(payload string)
+}
+
+func (b *fakeBus) Notify(channel, payload string) error {
+	for _, handle := range b.listeners {
+		handle(payload)
+	}
+	return nil
+}
+
+func (b *fakeBus) Listen(channel string, handle func(payload string)) {
+	b.listeners = append(b.listeners, handle)
+}
+
+// subscribe - will count the mentions delivered to the user.
+func subscribe(h *Hub, userID string) (*int, func()) {
+	delivered := 0
+	unsubscribe := h.Subscribe(userID, func(model.Mention) {
+		delivered++
+	})
+	return &delivered, unsubscribe
+}
+
+func TestMentionDeliveredToEverySubscriber(t *testing.T) {
+	hub := NewHub(nil)
+	laptop, unsubscribeLaptop := subscribe(hub, "1")
+	phone, _ := subscribe(hub, "1")
+	other, _ := subscribe(hub, "2")
+
+	hub.Publish(model.Mention{ID: 1, UserID: "1"})
+	unsubscribeLaptop()
+	hub.Publish(model.Mention{ID: 2, UserID: "1"})
+
+	if *laptop != 1 || *phone != 2 || *other != 0 {
+		t.Errorf("Delivered %v, %v and %v mentions, want 1, 2 and 0", *laptop, *phone, *other)
+	}
+}
+
+func TestMentionDeliveredAcrossInstances(t *testing.T) {
+	bus := &fakeBus{}
+	first, second := NewHub(bus), NewHub(bus)
+	local, _ := subscribe(first, "1")
+	remote, _ := subscribe(second, "1")
+
+	first.Publish(model.Mention{ID: 1, UserID: "1"})
+
+	if *local != 1 || *remote != 1 {
+		t.Errorf("Delivered %v mentions locally and %v remotely, want one each", *local, *remote)
+	}
+}
+
+func TestNilHubDeliversNothing(t *testing.T) {
+	var hub *Hub
+	hub.Subscribe("1", func(model.Mention) { t.Errorf("Delivered a mention, want none") })()
+	hub.Publish(model.Mention{ID: 1, UserID: "1"})
+}
@@ -3,28 +3,119 @@ package model
 
 import (
 	"fmt"
+	"time"
 )
 
 // Message - a message entity.
 type Message struct {
-	UserID    string `json:"userId,omitempty"`
-	Username  string `json:"username,omitempty"`
-	Timestamp string `json:"timestamp,omitempty"`
-	Text      string `json:"text,omitempty"`
-	ChatGUID  string `json:"chatGuid,omitempty"`
+	ID          int64  `json:"id,omitempty"`
+	UserID      string `json:"userId,omitempty"`
+	Username    string `json:"username,omitempty"`
+	Timestamp   string `json:"timestamp,omitempty"`
+	Text        string `json:"text,omitempty"`
+	ChatGUID    string `json:"chatGuid,omitempty"`
+	ClientMsgID string `json:"clientMsgId,omitempty"`
+	Seq         int64  `json:"seq,omitempty"`
+	Kind        string `json:"kind,omitempty"`
+	// Annotations are attached by the message pipeline, delivered with the message and never saved.
+	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
+// Message kinds. Plain text messages have no kind.
+// Actions are sent with the /me command, system messages are generated by the server and never saved.
+const (
+	MessageKindAction = "action"
+	MessageKindSystem = "system"
+)
+
 // Payload - an entity of WS exchange body.
 type Payload struct {
-	Messages     []Message     `json:"messages,omitempty"`
-	PageToken    string        `json:"pageToken,omitempty"`
-	Notification *Notification `json:"notification,omitempty"`
+	Messages     []Message               `json:"messages,omitempty"`
+	PageToken    string                  `json:"pageToken,omitempty"`
+	PageSize     int                     `json:"pageSize,omitempty"`
+	HasMore      bool                    `json:"hasMore,omitempty"`
+	SeqFrom      int64                   `json:"seqFrom,omitempty"`
+	SeqTo        int64                   `json:"seqTo,omitempty"`
+	Resync       bool                    `json:"resync,omitempty"`
+	RequestID    string                  `json:"requestId,omitempty"`
+	Ack          *Ack                    `json:"ack,omitempty"`
+	Notification *Notification           `json:"notification,omitempty"`
+	Membership   *MembershipNotification `json:"membership,omitempty"`
+	Typing       *TypingNotification     `json:"typing,omitempty"`
+	Mention      *Mention                `json:"mention,omitempty"`
+	Chat         *Chat                   `json:"chat,omitempty"`
 }
 
-// Notification - a message that notifies that a user is online / offline.
+// Frame types of the typed protocol.
+const (
+	TypeMessage    = "message"
+	TypeHistory    = "history"
+	TypeRange      = "range"
+	TypePresence   = "presence"
+	TypeTyping     = "typing"
+	TypeMembership = "membership"
+	TypeAck        = "ack"
+	TypeMention    = "mention"
+	TypeChat       = "chat"
+)
+
+// Envelope - a frame of the typed protocol: a payload with its type and the version of the protocol.
+// Clients that didn't negotiate the typed protocol exchange bare payloads.
+type Envelope struct {
+	Version int    `json:"version,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Payload
+}
+
+// Reasons a message frame is rejected for.
+const (
+	ReasonInvalid     = "invalid"
+	ReasonEmpty       = "empty"
+	ReasonTooLong     = "too_long"
+	ReasonRateLimited = "rate_limited"
+	ReasonForbidden   = "forbidden"
+	ReasonMuted       = "muted"
+	ReasonInternal    = "internal"
+)
+
+// Ack - the answer to a message frame, correlated by the request ID the client sent the frame with.
+// An accepted message is acknowledged with its persisted ID and sequence number, a rejected one with a reason
+// and, if there's more to say, the details.
+type Ack struct {
+	RequestID string `json:"requestId,omitempty"`
+	OK        bool   `json:"ok"`
+	ID        int64  `json:"id,omitempty"`
+	Seq       int64  `json:"seq,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Details   string `json:"details,omitempty"`
+}
+
+// Notification - a message that notifies that a user is online / away / offline.
+// Clients send it without the client to tell whether they are online or away.
 type Notification struct {
 	Client   *Client `json:"client,omitempty"`
 	IsOnline bool    `json:"isOnline,omitempty"`
+	State    string  `json:"state,omitempty"`
+}
+
+// TypingNotification - a message that notifies that a user started / stopped typing.
+// Clients send it without the client, the server fills it in when relaying.
+type TypingNotification struct {
+	Client   *Client `json:"client,omitempty"`
+	IsTyping bool    `json:"isTyping,omitempty"`
+}
+
+// Mention - a record of a user being mentioned in a message, delivered to the user whichever chat they are in.
+type Mention struct {
+	ID      int64   `json:"id,omitempty"`
+	UserID  string  `json:"userId,omitempty"`
+	Message Message `json:"message"`
+}
+
+// MembershipNotification - a message that notifies that a user was added to / removed from the chat.
+type MembershipNotification struct {
+	Client   *Client `json:"client,omitempty"`
+	IsMember bool    `json:"isMember,omitempty"`
 }
 
 /*
@@ -39,6 +130,7 @@ func (m Message) String() string {
 type Client struct {
 	UserID   string `json:"userId,omitempty"`
 	Username string `json:"username,omitempty"`
+	IP       string `json:"-"`
 }
 
 /*
@@ -48,3 +140,129 @@ type Client struct {
 func (c Client) String() string {
 	return fmt.Sprintf("UserID: %v; Username: %v", c.UserID, c.Username)
 }
+
+// AuditRecord - a structured record of a security-relevant event.
+type AuditRecord struct {
+	ID        int64     `json:"id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event,omitempty"`
+	ActorID   string    `json:"actorId,omitempty"`
+	ChatGUID  string    `json:"chatGuid,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Outcome   string    `json:"outcome,omitempty"`
+	Details   string    `json:"details,omitempty"`
+}
+
+/*
+	Format:
+	Event: string; Outcome: string; ActorID: string; ChatGUID: string; IP: string; Details: string;
+*/
+func (r AuditRecord) String() string {
+	return fmt.Sprintf("Event: %v; Outcome: %v; ActorID: %v; ChatGUID: %v; IP: %v; Details: %v", r.Event, r.Outcome, r.ActorID, r.ChatGUID, r.IP, r.Details)
+}
+
+// AuditFilter - a set of optional constraints used when querying audit records.
+// Zero values mean "no constraint". Records are returned newest first, starting below BeforeID if it is set.
+type AuditFilter struct {
+	ActorID  string
+	ChatGUID string
+	Event    string
+	Outcome  string
+	IP       string
+	Since    time.Time
+	Until    time.Time
+	BeforeID int64
+	Limit    int
+}
+
+// Chat kinds.
+const (
+	ChatKindGroup  = "group"
+	ChatKindDirect = "direct"
+)
+
+// Limits of the chat metadata, in characters.
+const (
+	MaxChatTitleLength       = 200
+	MaxChatTopicLength       = 300
+	MaxChatDescriptionLength = 2000
+	MaxChatAvatarLength      = 500
+)
+
+// Chat - a chat entity. Avatar is a reference to an image, like a URL.
+// Peer is only set on direct chats listed for one of their two members.
+type Chat struct {
+	GUID        string    `json:"guid,omitempty"`
+	Kind        string    `json:"kind,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	Topic       string    `json:"topic,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Avatar      string    `json:"avatar,omitempty"`
+	CreatedBy   string    `json:"createdBy,omitempty"`
+	CreatedAt   time.Time `json:"createdAt,omitempty"`
+	Peer        *Client   `json:"peer,omitempty"`
+}
+
+// EditableBy - tells whether the member may change the metadata of the chat: either member of a direct chat,
+// a moderator of a group chat, or any member of a chat that predates the chats table and has no owner.
+func (c Chat) EditableBy(member Member) bool {
+	return c.Kind == ChatKindDirect || c.CreatedBy == "" || IsModerator(member.Role)
+}
+
+// Roles of chat members, from the most to the least privileged.
+// Owners and admins moderate the chat, read-only members can't post.
+const (
+	RoleOwner    = "owner"
+	RoleAdmin    = "admin"
+	RoleMember   = "member"
+	RoleReadOnly = "read_only"
+)
+
+// roleRanks - the privilege of every role, the higher the more privileged.
+var roleRanks = map[string]int{
+	RoleOwner:    3,
+	RoleAdmin:    2,
+	RoleMember:   1,
+	RoleReadOnly: 0,
+}
+
+// ValidRole - tells whether the role exists.
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// IsModerator - tells whether members of the role moderate the chat.
+func IsModerator(role string) bool {
+	return role == RoleOwner || role == RoleAdmin
+}
+
+// CanModerate - tells whether a member of the actor's role may moderate a member of the target's role,
+// or grant the target's role: only moderators may, and only below their own role.
+func CanModerate(actorRole, targetRole string) bool {
+	return IsModerator(actorRole) && roleRanks[actorRole] > roleRanks[targetRole]
+}
+
+// MaxMuteDuration - the longest a member can be muted for at once.
+const MaxMuteDuration = 365 * 24 * time.Hour
+
+// Member - a member of a chat, with the role in it. MutedUntil is set if the member was muted.
+type Member struct {
+	Client
+	Nickname   string     `json:"nickname,omitempty"`
+	Role       string     `json:"role,omitempty"`
+	MutedUntil *time.Time `json:"mutedUntil,omitempty"`
+}
+
+// Muted - tells whether the member is muted at the time.
+func (m Member) Muted(at time.Time) bool {
+	return m.MutedUntil != nil && at.Before(*m.MutedUntil)
+}
+
+// Ban - a user banned from a chat, who can't join it or be added to it again until unbanned.
+type Ban struct {
+	UserID    string    `json:"userId,omitempty"`
+	BannedBy  string    `json:"bannedBy,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+}
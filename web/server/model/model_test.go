@@ -0,0 +1,46 @@
+package model
+
+import "testing"
+
+func TestCanModerate(t *testing.T) {
+	roles := []string{RoleOwner, RoleAdmin, RoleMember, RoleReadOnly}
+	// want[actor][target] - whether the actor's role may moderate the target's role.
+	want := [][]bool{
+		{false, true, true, true},
+		{false, false, true, true},
+		{false, false, false, false},
+		{false, false, false, false},
+	}
+
+	for i, actor := range roles {
+		for j, target := range roles {
+			if got := CanModerate(actor, target); got != want[i][j] {
+				t.Errorf("Got %v for %s moderating %s, want %v", got, actor, target, want[i][j])
+			}
+		}
+	}
+	if CanModerate("superuser", RoleReadOnly) || !CanModerate(RoleAdmin, "superuser") {
+		t.Errorf("Unknown roles aren't treated as the least privileged")
+	}
+}
+
+func TestChatEditableBy(t *testing.T) {
+	tests := []struct {
+		chat Chat
+		role string
+		want bool
+	}{
+		{Chat{Kind: ChatKindGroup, CreatedBy: "1"}, RoleOwner, true},
+		{Chat{Kind: ChatKindGroup, CreatedBy: "1"}, RoleAdmin, true},
+		{Chat{Kind: ChatKindGroup, CreatedBy: "1"}, RoleMember, false},
+		{Chat{Kind: ChatKindGroup, CreatedBy: "1"}, RoleReadOnly, false},
+		{Chat{Kind: ChatKindGroup}, RoleMember, true},
+		{Chat{Kind: ChatKindDirect, CreatedBy: "1"}, RoleMember, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.chat.EditableBy(Member{Role: tt.role}); got != tt.want {
+			t.Errorf("Got %v for %s of %+v, want %v", got, tt.role, tt.chat, tt.want)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+// Package presence tracks which users are online in which chats.
+// A user's presence in a chat is aggregated over all of their connections, on this and on other instances:
+// the user is online if any connection is online, away if all of them are away, and offline if there are none.
+// Subscribers only hear about real transitions of the aggregated state.
+package presence
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/config"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"sync"
+	"time"
+)
+
+// States of presence.
+const (
+	Online  = "online"
+	Away    = "away"
+	Offline = "offline"
+)
+
+// channel - the notification channel instances exchange presence on.
+const channel = "presence"
+
+// Bus - a way to exchange presence with other instances, implemented by the database package.
+type Bus interface {
+	Notify(channel, payload string) error
+	Listen(channel string, handle func(payload string))
+}
+
+// busMessage - the presence of a user in a chat on one instance.
+type busMessage struct {
+	Instance string       `json:"instance"`
+	ChatGUID string       `json:"chatGuid"`
+	Client   model.Client `json:"client"`
+	State    string       `json:"state"`
+}
+
+// key - identifies the presence of a user in a chat.
+type key struct {
+	chatGUID string
+	userID   string
+}
+
+// remoteState - the presence of a user on another instance, with the time it was last heard of.
+type remoteState struct {
+	state string
+	seen  time.Time
+}
+
+// entry - the presence of a user in a chat, over all connections.
+type entry struct {
+	client    model.Client
+	local     map[interface{}]string
+	remote    map[string]remoteState
+	published string
+	state     string
+}
+
+// Tracker - keeps track of presence and notifies subscribers of its transitions.
+type Tracker struct {
+	instance    string
+	bus         Bus
+	heartbeat   time.Duration
+	mu          sync.Mutex
+	entries     map[key]*entry
+	subscribers map[string]map[int]func(model.Notification)
+	nextID      int
+	outbox      chan busMessage
+	done        chan struct{}
+	flushed     chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewTracker - will construct and return a Tracker. If bus is not nil, presence is shared with the other instances
+// and re-announced every PRESENCE_HEARTBEAT; presence of an instance not heard of for three heartbeats expires.
+func NewTracker(bus Bus) *Tracker {
+	instance := make([]byte, 8)
+	if _, err := rand.Read(instance); err != nil {
+		log.Logger.Fatal(err)
+	}
+
+	t := &Tracker{
+		instance:    hex.EncodeToString(instance),
+		bus:         bus,
+		heartbeat:   config.Duration("PRESENCE_HEARTBEAT", 30*time.Second),
+		entries:     make(map[key]*entry),
+		subscribers: make(map[string]map[int]func(model.Notification)),
+		outbox:      make(chan busMessage, 256),
+		done:        make(chan struct{}),
+		flushed:     make(chan struct{}),
+	}
+
+	if bus != nil {
+		bus.Listen(channel, t.receive)
+		go t.publishHandler()
+		go t.heartbeatHandler()
+	}
+
+	return t
+}
+
+// Subscribe - will call notify with every transition of presence in the chat, until unsubscribed.
+func (t *Tracker) Subscribe(chatGUID string, notify func(model.Notification)) (unsubscribe func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.subscribers[chatGUID] == nil {
+		t.subscribers[chatGUID] = make(map[int]func(model.Notification))
+	}
+	id := t.nextID
+	t.nextID++
+	t.subscribers[chatGUID][id] = notify
+
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.subscribers[chatGUID], id)
+		if len(t.subscribers[chatGUID]) == 0 {
+			delete(t.subscribers, chatGUID)
+		}
+	}
+}
+
+// Connect - will count a new connection of the user to the chat, which starts online.
+func (t *Tracker) Connect(chatGUID string, client model.Client, conn interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	k := key{chatGUID: chatGUID, userID: client.UserID}
+	e := t.entry(k, client)
+	e.local[conn] = Online
+	t.update(k, e)
+}
+
+// SetState - will change the state of the user's connection to the chat to either Online or Away.
+func (t *Tracker) SetState(chatGUID, userID string, conn interface{}, state string) {
+	if state != Online && state != Away {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	k := key{chatGUID: chatGUID, userID: userID}
+	e, ok := t.entries[k]
+	if !ok {
+		return
+	}
+	if _, ok := e.local[conn]; !ok {
+		return
+	}
+	e.local[conn] = state
+	t.update(k, e)
+}
+
+// Disconnect - will forget the user's connection to the chat.
+func (t *Tracker) Disconnect(chatGUID, userID string, conn interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	k := key{chatGUID: chatGUID, userID: userID}
+	e, ok := t.entries[k]
+	if !ok {
+		return
+	}
+	delete(e.local, conn)
+	t.update(k, e)
+}
+
+// Snapshot - will return the presence of every user who is not offline in the chat.
+func (t *Tracker) Snapshot(chatGUID string) []model.Notification {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	notifications := make([]model.Notification, 0)
+	for k, e := range t.entries {
+		if k.chatGUID == chatGUID && e.state != Offline {
+			notifications = append(notifications, notification(e))
+		}
+	}
+	return notifications
+}
+
+// Close - will announce to the other instances that all users of this instance went offline, and stop sharing presence.
+func (t *Tracker) Close() {
+	t.closeOnce.Do(func() {
+		t.mu.Lock()
+		for k, e := range t.entries {
+			if e.published != Offline {
+				t.publish(k, e, Offline)
+			}
+		}
+		t.mu.Unlock()
+
+		if t.bus != nil {
+			close(t.done)
+			<-t.flushed
+		}
+	})
+}
+
+// entry - will return the entry of the key, creating it if needed. Must be called with mu held.
+func (t *Tracker) entry(k key, client model.Client) *entry {
+	e, ok := t.entries[k]
+	if !ok {
+		e = &entry{
+			client:    client,
+			local:     make(map[interface{}]string),
+			remote:    make(map[string]remoteState),
+			published: Offline,
+			state:     Offline,
+		}
+		t.entries[k] = e
+	}
+	return e
+}
+
+// update - will re-aggregate the entry, publishing a change of this instance's state to the other instances,
+// and a change of the overall state to the subscribers. Must be called with mu held.
+func (t *Tracker) update(k key, e *entry) {
+	states := make([]string, 0, len(e.local)+len(e.remote))
+	for _, state := range e.local {
+		states = append(states, state)
+	}
+	if local := aggregate(states); local != e.published {
+		t.publish(k, e, local)
+	}
+	for _, remote := range e.remote {
+		states = append(states, remote.state)
+	}
+
+	if state := aggregate(states); state != e.state {
+		e.state = state
+		log.Logger.Infof("Presence of [%s] in the chat with GUID %s is now %s", e.client, k.chatGUID, state)
+		for _, notify := range t.subscribers[k.chatGUID] {
+			notify(notification(e))
+		}
+	}
+
+	if len(e.local) == 0 && len(e.remote) == 0 {
+		delete(t.entries, k)
+	}
+}
+
+// publish - will queue the state of the entry on this instance for the other instances. Must be called with mu held.
+func (t *Tracker) publish(k key, e *entry, state string) {
+	e.published = state
+	if t.bus == nil {
+		return
+	}
+	select {
+	case t.outbox <- busMessage{Instance: t.instance, ChatGUID: k.chatGUID, Client: e.client, State: state}:
+	default:
+		log.Logger.Warnf("Presence outbox is full, the next heartbeat will catch up on [%s]", e.client)
+	}
+}
+
+// receive - will apply the presence announced by another instance.
+func (t *Tracker) receive(payload string) {
+	var msg busMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		log.Logger.Errorf("Malformed presence notification - %s", err)
+		return
+	}
+	if msg.Instance == t.instance {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	k := key{chatGUID: msg.ChatGUID, userID: msg.Client.UserID}
+	if msg.State == Offline {
+		e, ok := t.entries[k]
+		if !ok {
+			return
+		}
+		delete(e.remote, msg.Instance)
+		t.update(k, e)
+		return
+	}
+
+	e := t.entry(k, msg.Client)
+	e.remote[msg.Instance] = remoteState{state: msg.State, seen: time.Now()}
+	t.update(k, e)
+}
+
+// A go routine that monitors the outbox and publishes presence to the other instances.
+// Once the tracker is closed, it flushes the outbox and exits.
+func (t *Tracker) publishHandler() {
+	defer close(t.flushed)
+	for {
+		select {
+		case msg := <-t.outbox:
+			t.send(msg)
+		case <-t.done:
+			for {
+				select {
+				case msg := <-t.outbox:
+					t.send(msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// send - will publish the presence to the other instances.
+func (t *Tracker) send(msg busMessage) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Logger.Error(err)
+		return
+	}
+	if err := t.bus.Notify(channel, string(payload)); err != nil {
+		log.Logger.Errorf("Couldn't publish presence - %s", err)
+	}
+}
+
+// A go routine that periodically re-announces this instance's presence and expires presence of silent instances.
+func (t *Tracker) heartbeatHandler() {
+	ticker := time.NewTicker(t.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+
+		t.mu.Lock()
+		for k, e := range t.entries {
+			if e.published != Offline {
+				t.publish(k, e, e.published)
+			}
+			for instance, remote := range e.remote {
+				if time.Since(remote.seen) > 3*t.heartbeat {
+					log.Logger.Warnf("Instance %s went silent, expiring its presence of [%s]", instance, e.client)
+					delete(e.remote, instance)
+				}
+			}
+			t.update(k, e)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// aggregate - will combine the states of several connections into one.
+func aggregate(states []string) string {
+	result := Offline
+	for _, state := range states {
+		if state == Online {
+			return Online
+		}
+		if state == Away {
+			result = Away
+		}
+	}
+	return result
+}
+
+// notification - will describe the entry's overall state as a notification.
+func notification(e *entry) model.Notification {
+	client := e.client
+	return model.Notification{
+		Client:   &client,
+		IsOnline: e.state != Offline,
+		State:    e.state,
+	}
+}
@@ -0,0 +1,65 @@
+package presence
+
+import (
+	"encoding/json"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.Logger.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// subscribe - will collect the states of every transition in the chat.
+func subscribe(t *Tracker, chatGUID string) *[]string {
+	states := make([]string, 0)
+	t.Subscribe(chatGUID, func(notification model.Notification) {
+		states = append(states, notification.State)
+	})
+	return &states
+}
+
+func TestPresenceAggregatedOverDevices(t *testing.T) {
+	tracker := NewTracker(nil)
+	states := subscribe(tracker, "guid")
+	user := model.Client{UserID: "1", Username: "tester"}
+
+	tracker.Connect("guid", user, "laptop")
+	tracker.Connect("guid", user, "phone")
+	tracker.Disconnect("guid", user.UserID, "laptop")
+	tracker.SetState("guid", user.UserID, "phone", Away)
+	tracker.SetState("guid", user.UserID, "phone", Away)
+	tracker.Disconnect("guid", user.UserID, "phone")
+
+	if want := []string{Online, Away, Offline}; !reflect.DeepEqual(*states, want) {
+		t.Errorf("Got transitions %v, want %v", *states, want)
+	}
+	if snapshot := tracker.Snapshot("guid"); len(snapshot) != 0 {
+		t.Errorf("Got %v users present, want none", len(snapshot))
+	}
+}
+
+func TestPresenceAggregatedOverInstances(t *testing.T) {
+	tracker := NewTracker(nil)
+	states := subscribe(tracker, "guid")
+	user := model.Client{UserID: "1", Username: "tester"}
+
+	announce := func(state string) {
+		payload, _ := json.Marshal(busMessage{Instance: "other", ChatGUID: "guid", Client: user, State: state})
+		tracker.receive(string(payload))
+	}
+
+	announce(Away)
+	tracker.Connect("guid", user, "laptop")
+	tracker.Disconnect("guid", user.UserID, "laptop")
+	announce(Offline)
+
+	if want := []string{Away, Online, Away, Offline}; !reflect.DeepEqual(*states, want) {
+		t.Errorf("Got transitions %v, want %v", *states, want)
+	}
+}
@@ -0,0 +1,237 @@
+// Package ratelimit limits how fast clients can send messages, with token buckets per connection, per user and per chat,
+// and escalates sustained flooding from rejected messages to a temporary mute and then a disconnect.
+package ratelimit
+
+import (
+	"gitlab.starlink.ua/high-school-prod/chat/server/config"
+	"sync"
+	"time"
+)
+
+// Verdict - what happens to a message checked against the limits.
+type Verdict int
+
+// Verdicts, from the mildest.
+const (
+	// Allow - the message is within the limits.
+	Allow Verdict = iota
+	// Limit - the message is rejected.
+	Limit
+	// Mute - the message is rejected, and so is every message of the user until the mute expires.
+	Mute
+	// Disconnect - the message is rejected, and the sender is to be disconnected.
+	Disconnect
+)
+
+// Bucket - a token bucket, holding up to burst tokens and refilled with rate tokens per second.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket - will construct and return a full Bucket. A rate that is not positive means no limit.
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Allow - will take a token from the bucket. Returns false if there's none left.
+func (b *Bucket) Allow() bool {
+	if b == nil || b.rate <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// available - will tell whether the bucket has a token to take, without taking it.
+func (b *Bucket) available() bool {
+	if b == nil || b.rate <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return b.tokens >= 1
+}
+
+// allowAll - will take a token from each of the buckets if all of them have one, and from none of them otherwise.
+func allowAll(buckets ...*Bucket) bool {
+	for _, bucket := range buckets {
+		if !bucket.available() {
+			return false
+		}
+	}
+	for _, bucket := range buckets {
+		bucket.Allow()
+	}
+	return true
+}
+
+// full - will tell whether the bucket has refilled completely, i.e. hasn't been used for a while.
+func (b *Bucket) full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return b.tokens >= b.burst
+}
+
+// refill - will add the tokens accumulated since the last refill. Must be called with mu held.
+func (b *Bucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// offender - a user whose messages were rejected recently.
+type offender struct {
+	strikes    int
+	last       time.Time
+	mutedUntil time.Time
+}
+
+// Limiter - the limits shared by all sessions: a bucket per user, over all of the user's chats and devices,
+// and the record of the users' rejected messages.
+type Limiter struct {
+	mu              sync.Mutex
+	rate            float64
+	burst           int
+	users           map[string]*Bucket
+	offenders       map[string]*offender
+	strikeWindow    time.Duration
+	muteAfter       int
+	muteFor         time.Duration
+	disconnectAfter int
+	lastSweep       time.Time
+}
+
+// NewLimiter - will construct a Limiter using RATE_LIMIT_USER (messages per second) and RATE_LIMIT_USER_BURST.
+// A user whose messages keep getting rejected, with no more than RATE_LIMIT_STRIKE_WINDOW between the rejections,
+// is muted for RATE_LIMIT_MUTE_DURATION after RATE_LIMIT_MUTE_AFTER rejections,
+// and disconnected after RATE_LIMIT_DISCONNECT_AFTER rejections.
+func NewLimiter() *Limiter {
+	return &Limiter{
+		rate:            config.Float("RATE_LIMIT_USER", 5),
+		burst:           config.Int("RATE_LIMIT_USER_BURST", 10),
+		users:           make(map[string]*Bucket),
+		offenders:       make(map[string]*offender),
+		strikeWindow:    config.Duration("RATE_LIMIT_STRIKE_WINDOW", 10*time.Second),
+		muteAfter:       config.Int("RATE_LIMIT_MUTE_AFTER", 10),
+		muteFor:         config.Duration("RATE_LIMIT_MUTE_DURATION", 30*time.Second),
+		disconnectAfter: config.Int("RATE_LIMIT_DISCONNECT_AFTER", 30),
+		lastSweep:       time.Now(),
+	}
+}
+
+// NewConnectionBucket - will construct the bucket of a single connection,
+// using RATE_LIMIT_CONNECTION (messages per second) and RATE_LIMIT_CONNECTION_BURST.
+func NewConnectionBucket() *Bucket {
+	return NewBucket(config.Float("RATE_LIMIT_CONNECTION", 3), config.Int("RATE_LIMIT_CONNECTION_BURST", 6))
+}
+
+// NewChatBucket - will construct the bucket of a whole chat, using RATE_LIMIT_CHAT (messages per second)
+// and RATE_LIMIT_CHAT_BURST.
+func NewChatBucket() *Bucket {
+	return NewBucket(config.Float("RATE_LIMIT_CHAT", 50), config.Int("RATE_LIMIT_CHAT_BURST", 100))
+}
+
+// Check - will take a token for the user's message from the user's bucket, the bucket of the user's connection
+// and the bucket of the chat, and tell what happens to the message. Tokens are only taken if all of the buckets
+// have one. Only messages over the user's own limits count towards muting and disconnecting the user,
+// so that a chat flooded by others doesn't punish its members. A nil Limiter only checks the given buckets.
+func (l *Limiter) Check(userID string, conn, chat *Bucket) Verdict {
+	if l == nil {
+		if !allowAll(conn, chat) {
+			return Limit
+		}
+		return Allow
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	o, offending := l.offenders[userID]
+	if offending && now.Before(o.mutedUntil) {
+		return l.strike(userID, now)
+	}
+
+	user, ok := l.users[userID]
+	if !ok {
+		user = NewBucket(l.rate, l.burst)
+		l.users[userID] = user
+	}
+	if !conn.available() || !user.available() {
+		return l.strike(userID, now)
+	}
+	if !allowAll(conn, user, chat) {
+		return Limit
+	}
+	return Allow
+}
+
+// strike - will record a rejected message of the user and escalate if the user keeps flooding.
+// Must be called with mu held.
+func (l *Limiter) strike(userID string, now time.Time) Verdict {
+	o, ok := l.offenders[userID]
+	if !ok {
+		o = &offender{}
+		l.offenders[userID] = o
+	}
+	if now.Sub(o.last) > l.strikeWindow {
+		o.strikes = 0
+	}
+	o.strikes++
+	o.last = now
+
+	switch {
+	case l.disconnectAfter > 0 && o.strikes >= l.disconnectAfter:
+		delete(l.offenders, userID)
+		return Disconnect
+	case l.muteAfter > 0 && o.strikes == l.muteAfter:
+		o.mutedUntil = now.Add(l.muteFor)
+		return Mute
+	default:
+		return Limit
+	}
+}
+
+// sweep - will forget the users who haven't sent anything for a while, at most once a minute. Must be called with mu held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for userID, bucket := range l.users {
+		if bucket.full() {
+			delete(l.users, userID)
+		}
+	}
+	for userID, o := range l.offenders {
+		if now.Sub(o.last) > l.strikeWindow && now.After(o.mutedUntil) {
+			delete(l.offenders, userID)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	bucket := NewBucket(100, 2)
+	if !bucket.Allow() || !bucket.Allow() {
+		t.Fatalf("Full bucket rejected a message, want it allowed")
+	}
+	if bucket.Allow() {
+		t.Errorf("Empty bucket allowed a message, want it rejected")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if !bucket.Allow() {
+		t.Errorf("Refilled bucket rejected a message, want it allowed")
+	}
+
+	unlimited := NewBucket(0, 1)
+	for i := 0; i < 10; i++ {
+		if !unlimited.Allow() {
+			t.Fatalf("Bucket without a rate rejected a message, want it allowed")
+		}
+	}
+}
+
+func TestLimiterEscalates(t *testing.T) {
+	os.Setenv("RATE_LIMIT_USER", "0.001")
+	os.Setenv("RATE_LIMIT_USER_BURST", "1")
+	os.Setenv("RATE_LIMIT_MUTE_AFTER", "2")
+	os.Setenv("RATE_LIMIT_DISCONNECT_AFTER", "4")
+	defer os.Unsetenv("RATE_LIMIT_USER")
+	defer os.Unsetenv("RATE_LIMIT_USER_BURST")
+	defer os.Unsetenv("RATE_LIMIT_MUTE_AFTER")
+	defer os.Unsetenv("RATE_LIMIT_DISCONNECT_AFTER")
+
+	limiter := NewLimiter()
+	want := []Verdict{Allow, Limit, Mute, Limit, Disconnect}
+	for i, verdict := range want {
+		if got := limiter.Check("flooder", nil, nil); got != verdict {
+			t.Errorf("Verdict on message %v is %v, want %v", i, got, verdict)
+		}
+	}
+
+	// Other users aren't affected.
+	if got := limiter.Check("bystander", nil, nil); got != Allow {
+		t.Errorf("Verdict on a bystander's message is %v, want %v", got, Allow)
+	}
+
+	// The buckets given are checked too.
+	if got := limiter.Check("another", NewBucket(0.001, 1), NewBucket(0.001, 1)); got != Allow {
+		t.Errorf("Verdict on a message within all limits is %v, want %v", got, Allow)
+	}
+	empty := NewBucket(0.001, 1)
+	empty.Allow()
+	if got := limiter.Check("yet another", empty, nil); got != Limit {
+		t.Errorf("Verdict on a message over a given limit is %v, want %v", got, Limit)
+	}
+}
+
+// TestFloodedChatPunishesNobody - a user flooding a chat empties the chat's bucket, but the other members posting
+// meanwhile are only limited, never muted or disconnected, and aren't charged for the rejected messages.
+func TestFloodedChatPunishesNobody(t *testing.T) {
+	os.Setenv("RATE_LIMIT_USER", "1000")
+	os.Setenv("RATE_LIMIT_USER_BURST", "1000")
+	os.Setenv("RATE_LIMIT_MUTE_AFTER", "2")
+	os.Setenv("RATE_LIMIT_DISCONNECT_AFTER", "4")
+	defer os.Unsetenv("RATE_LIMIT_USER")
+	defer os.Unsetenv("RATE_LIMIT_USER_BURST")
+	defer os.Unsetenv("RATE_LIMIT_MUTE_AFTER")
+	defer os.Unsetenv("RATE_LIMIT_DISCONNECT_AFTER")
+
+	limiter := NewLimiter()
+	chat := NewBucket(0.001, 5)
+	for i := 0; i < 5; i++ {
+		if got := limiter.Check("a", nil, chat); got != Allow {
+			t.Fatalf("Verdict on message %v of the flooder is %v, want %v", i, got, Allow)
+		}
+	}
+
+	b := NewBucket(0.001, 1)
+	for i := 0; i < 20; i++ {
+		if got := limiter.Check("b", b, chat); got != Limit {
+			t.Fatalf("Verdict on message %v of a member of the flooded chat is %v, want %v", i, got, Limit)
+		}
+	}
+	if got := limiter.Check("a", nil, chat); got != Limit {
+		t.Errorf("Verdict on a message to the flooded chat is %v, want %v", got, Limit)
+	}
+
+	// The rejected messages took no token from the member's connection.
+	if got := limiter.Check("b", b, NewBucket(0.001, 1)); got != Allow {
+		t.Errorf("Verdict on a message to another chat is %v, want %v", got, Allow)
+	}
+}
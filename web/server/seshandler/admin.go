@@ -0,0 +1,108 @@
+package seshandler
+
+import (
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Limits of a single page of audit records.
+const (
+	defaultAuditPageSize = 50
+	maxAuditPageSize     = 500
+)
+
+// AuditPage - a page of audit records. NextCursor is empty when there are no older records.
+type AuditPage struct {
+	Records    []model.AuditRecord `json:"records"`
+	NextCursor string              `json:"nextCursor,omitempty"`
+}
+
+// HandleAudit - will serve the audit log to admins.
+// Supported query parameters: actor, chat, event, outcome, ip, since, until (RFC 3339), limit and cursor.
+func (sh *SessionHandler) HandleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	userID, _, err := authenticate(r)
+	if err != nil {
+		log.Logger.Warnf("Couldn't verify token: err [%s], denying access to the audit log...", err)
+		writeError(w, http.StatusUnauthorized, "Bad token")
+		return
+	}
+	if !isAdmin(userID) {
+		log.Logger.Warnf("User [%s] is not an admin, denying access to the audit log...", userID)
+		writeError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Read one record more than requested to find out whether there is a next page.
+	pageSize := filter.Limit
+	filter.Limit++
+	records, err := sh.db.ReadAuditRecords(filter)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read the audit log")
+		return
+	}
+
+	page := AuditPage{Records: records}
+	if len(records) > pageSize {
+		page.Records = records[:pageSize]
+		page.NextCursor = strconv.FormatInt(page.Records[pageSize-1].ID, 10)
+	}
+
+	writeData(w, http.StatusOK, page)
+}
+
+// parseAuditFilter - will build an audit filter from the request's query parameters.
+func parseAuditFilter(r *http.Request) (filter model.AuditFilter, err error) {
+	query := r.URL.Query()
+	filter = model.AuditFilter{
+		ActorID:  query.Get("actor"),
+		ChatGUID: query.Get("chat"),
+		Event:    query.Get("event"),
+		Outcome:  query.Get("outcome"),
+		IP:       query.Get("ip"),
+		Limit:    defaultAuditPageSize,
+	}
+
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, err
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, err
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			return filter, err
+		}
+		if filter.Limit < 1 {
+			filter.Limit = 1
+		}
+		if filter.Limit > maxAuditPageSize {
+			filter.Limit = maxAuditPageSize
+		}
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		if filter.BeforeID, err = strconv.ParseInt(cursor, 10, 64); err != nil {
+			return filter, err
+		}
+	}
+
+	return filter, nil
+}
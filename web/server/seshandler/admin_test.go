@@ -0,0 +1,96 @@
+package seshandler
+
+import (
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestParseAuditFilter(t *testing.T) {
+	tests := []struct {
+		query        string
+		wantLimit    int
+		wantBeforeID int64
+		wantErr      bool
+	}{
+		{"", defaultAuditPageSize, 0, false},
+		{"limit=20", 20, 0, false},
+		{"limit=0", 1, 0, false},
+		{"limit=-5", 1, 0, false},
+		{"limit=9999", maxAuditPageSize, 0, false},
+		{"limit=ten", 0, 0, true},
+		{"cursor=42", defaultAuditPageSize, 42, false},
+		{"cursor=last", 0, 0, true},
+		{"since=2020-01-01T00:00:00Z&until=2020-02-01T00:00:00Z", defaultAuditPageSize, 0, false},
+		{"since=yesterday", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		filter, err := parseAuditFilter(httptest.NewRequest(http.MethodGet, "/admin/audit?"+tt.query, nil))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Error %v for %q, want error %v", err, tt.query, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (filter.Limit != tt.wantLimit || filter.BeforeID != tt.wantBeforeID) {
+			t.Errorf("Got limit %v and cursor %v for %q, want %v and %v",
+				filter.Limit, filter.BeforeID, tt.query, tt.wantLimit, tt.wantBeforeID)
+		}
+	}
+}
+
+// TestHandleAuditPages - admins page through the filtered audit log by the cursor of the previous page.
+func TestHandleAuditPages(t *testing.T) {
+	os.Setenv("ADMIN_USER_IDS", "1")
+	defer os.Unsetenv("ADMIN_USER_IDS")
+
+	store := &fakeStore{}
+	for id := int64(1); id <= 7; id++ {
+		event := "join"
+		if id%3 == 0 {
+			event = "leave"
+		}
+		store.records = append(store.records, model.AuditRecord{ID: id, Event: event})
+	}
+	sh := newStoreHandler(store)
+
+	if status := serve(t, sh.HandleAudit, http.MethodGet, "/admin/audit", "2", "", nil); status != http.StatusForbidden {
+		t.Errorf("Got status %v for a user, want %v", status, http.StatusForbidden)
+	}
+	if status := serve(t, sh.HandleAudit, http.MethodGet, "/admin/audit", "", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Got status %v without a token, want %v", status, http.StatusUnauthorized)
+	}
+
+	var (
+		cursor string
+		got    []int64
+		pages  int
+	)
+	for {
+		var page AuditPage
+		status := serve(t, sh.HandleAudit, http.MethodGet, "/admin/audit?event=join&limit=2&cursor="+cursor, "1", "", &page)
+		if status != http.StatusOK {
+			t.Fatalf("Got status %v, want %v", status, http.StatusOK)
+		}
+		for _, record := range page.Records {
+			got = append(got, record.ID)
+		}
+		pages++
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	want := []int64{7, 5, 4, 2, 1}
+	if len(got) != len(want) || pages != 3 {
+		t.Fatalf("Got records %v in %v pages, want %v in 3", got, pages, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Got records %v, want %v", got, want)
+			break
+		}
+	}
+}
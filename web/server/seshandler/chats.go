@@ -0,0 +1,484 @@
+package seshandler
+
+import (
+	"encoding/json"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/audit"
+	"gitlab.starlink.ua/high-school-prod/chat/server/database"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// chatRequest - a body of the request creating a chat.
+type chatRequest struct {
+	Title string `json:"title"`
+}
+
+// chatUpdateRequest - a body of the request changing the metadata of a chat. Omitted fields stay as they are.
+type chatUpdateRequest struct {
+	Title       *string `json:"title"`
+	Topic       *string `json:"topic"`
+	Description *string `json:"description"`
+	Avatar      *string `json:"avatar"`
+}
+
+// memberRequest - a body of the request adding a member to a chat.
+type memberRequest struct {
+	UserID string `json:"userId"`
+}
+
+// HandleChats - will serve the chat and membership management API:
+//
+//	GET    /chats                           - list the user's chats
+//	POST   /chats                           - create a chat, the user becomes its first member
+//	GET    /chats/direct                    - list the user's direct chats
+//	PUT    /chats/direct/{userId}           - read the user's direct chat with another user, creating it if needed
+//	GET    /chats/{guid}                    - read a chat
+//	PATCH  /chats/{guid}                    - change the title, the topic, the description or the avatar of a chat
+//	GET    /chats/{guid}/members            - list the chat's members
+//	POST   /chats/{guid}/members            - add a member to the chat
+//	DELETE /chats/{guid}/members/{userId}   - remove a member from the chat, leaving it or kicking them
+//
+// and the moderation API, see moderation.go:
+//
+//	PUT    /chats/{guid}/members/{userId}/role - change the role of a member
+//	PUT    /chats/{guid}/members/{userId}/mute - keep a member from posting for a duration
+//	DELETE /chats/{guid}/members/{userId}/mute - let a muted member post again
+//	GET    /chats/{guid}/bans                  - list the users banned from the chat
+//	POST   /chats/{guid}/bans                  - ban a user from the chat, removing them if they are a member
+//	DELETE /chats/{guid}/bans/{userId}         - lift the ban of a user
+func (sh *SessionHandler) HandleChats(w http.ResponseWriter, r *http.Request) {
+	userID, username, err := authenticate(r)
+	if err != nil {
+		log.Logger.Warnf("Couldn't verify token: err [%s], dropping request...", err)
+		writeError(w, http.StatusUnauthorized, "Bad token")
+		return
+	}
+	user := &model.Client{UserID: userID, Username: username, IP: audit.ClientIP(r)}
+
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/chats"), "/"), "/")
+	switch {
+	case path[0] == "":
+		switch r.Method {
+		case http.MethodGet:
+			sh.listChats(w, user)
+		case http.MethodPost:
+			sh.createChat(w, r, user)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+		return
+	case path[0] == "direct":
+		switch {
+		case len(path) == 1 && r.Method == http.MethodGet:
+			sh.listDirectChats(w, user)
+		case len(path) == 2 && r.Method == http.MethodPut:
+			sh.directChat(w, path[1], user)
+		case len(path) > 2:
+			writeError(w, http.StatusNotFound, "Not found")
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+		return
+	case chatRoute(path) == "":
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	guid := path[0]
+	if !sh.db.ValidateUserChat(user.UserID, guid) {
+		log.Logger.Warnf("Bad guid [%s] : userID [%s], dropping request...", guid, user.UserID)
+		writeError(w, http.StatusNotFound, "Bad GUID")
+		return
+	}
+
+	switch route := chatRoute(path); {
+	case route == "{guid}" && r.Method == http.MethodGet:
+		sh.readChat(w, guid)
+	case route == "{guid}" && r.Method == http.MethodPatch:
+		sh.updateChat(w, r, guid, user)
+	case route == "{guid}/members" && r.Method == http.MethodGet:
+		sh.listMembers(w, guid)
+	case route == "{guid}/members" && r.Method == http.MethodPost:
+		if sh.membersFixed(w, guid, user) {
+			return
+		}
+		sh.addMember(w, r, guid, user)
+	case route == "{guid}/members/{userId}" && r.Method == http.MethodDelete:
+		if sh.membersFixed(w, guid, user) {
+			return
+		}
+		sh.removeMember(w, guid, path[2], user)
+	case route == "{guid}/members/{userId}/role" && r.Method == http.MethodPut:
+		sh.setRole(w, r, guid, path[2], user)
+	case route == "{guid}/members/{userId}/mute" && r.Method == http.MethodPut:
+		sh.muteMember(w, r, guid, path[2], user)
+	case route == "{guid}/members/{userId}/mute" && r.Method == http.MethodDelete:
+		sh.unmuteMember(w, guid, path[2], user)
+	case route == "{guid}/bans" && r.Method == http.MethodGet:
+		sh.listBans(w, guid, user)
+	case route == "{guid}/bans" && r.Method == http.MethodPost:
+		sh.banMember(w, r, guid, user)
+	case route == "{guid}/bans/{userId}" && r.Method == http.MethodDelete:
+		sh.unbanMember(w, guid, path[2], user)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// chatRoute - will return the route of the path within a chat, with the GUID and the user ID replaced by placeholders,
+// or an empty string if there's no such route.
+func chatRoute(path []string) string {
+	route := append([]string{"{guid}"}, path[1:]...)
+	if len(route) > 2 {
+		route[2] = "{userId}"
+	}
+	switch joined := strings.Join(route, "/"); joined {
+	case "{guid}", "{guid}/members", "{guid}/members/{userId}", "{guid}/members/{userId}/role",
+		"{guid}/members/{userId}/mute", "{guid}/bans", "{guid}/bans/{userId}":
+		return joined
+	}
+	return ""
+}
+
+// listChats - will respond with all chats of the user.
+func (sh *SessionHandler) listChats(w http.ResponseWriter, user *model.Client) {
+	chats, err := sh.db.ReadUserChats(user.UserID)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read chats")
+		return
+	}
+	writeData(w, http.StatusOK, chats)
+}
+
+// createChat - will create a chat and respond with it, including its GUID.
+func (sh *SessionHandler) createChat(w http.ResponseWriter, r *http.Request, user *model.Client) {
+	var request chatRequest
+	if !decodeRequest(w, r, &request) || !validTitle(w, request.Title) {
+		return
+	}
+
+	chat, err := sh.db.CreateChat(strings.TrimSpace(request.Title), user.UserID)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't create the chat")
+		return
+	}
+	log.Logger.Infof("User [%s] created the chat with GUID %s", user, chat.GUID)
+	sh.auditChat(audit.EventChatCreated, audit.OutcomeAllowed, user, chat.GUID, "")
+
+	writeData(w, http.StatusCreated, chat)
+}
+
+// listDirectChats - will respond with all direct chats of the user, each with the other member as its peer.
+func (sh *SessionHandler) listDirectChats(w http.ResponseWriter, user *model.Client) {
+	chats, err := sh.db.ReadUserDirectChats(user.UserID)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read chats")
+		return
+	}
+	writeData(w, http.StatusOK, chats)
+}
+
+// directChat - will respond with the direct chat between the user and the peer, creating it if needed.
+// The chat is an ordinary chat with exactly two members, so it's served by the same sessions as group chats.
+func (sh *SessionHandler) directChat(w http.ResponseWriter, peerID string, user *model.Client) {
+	if _, err := strconv.Atoi(peerID); err != nil {
+		writeError(w, http.StatusBadRequest, "Bad user ID")
+		return
+	}
+
+	peer, err := sh.db.ReadUser(peerID)
+	if err == database.ErrNotFound {
+		writeError(w, http.StatusNotFound, "No such user")
+		return
+	}
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read the user")
+		return
+	}
+	// Compared once read, since the ID in the path may be spelled differently, like "01" or "+1".
+	if peer.UserID == user.UserID {
+		writeError(w, http.StatusBadRequest, "Bad user ID")
+		return
+	}
+
+	chat, created, err := sh.db.DirectChat(user.UserID, peer.UserID)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't create the chat")
+		return
+	}
+	chat.Peer = &peer
+
+	status := http.StatusOK
+	if created {
+		log.Logger.Infof("User [%s] started the direct chat with [%s], GUID %s", user, peer, chat.GUID)
+		sh.auditChat(audit.EventChatCreated, audit.OutcomeAllowed, user, chat.GUID, "direct with "+peer.UserID)
+		status = http.StatusCreated
+	}
+	writeData(w, status, chat)
+}
+
+// membersFixed - will check whether the chat is a direct one, whose members can't change,
+// responding with an error if it is.
+func (sh *SessionHandler) membersFixed(w http.ResponseWriter, guid string, user *model.Client) bool {
+	chat, err := sh.db.ReadChat(guid)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read the chat")
+		return true
+	}
+	if chat.Kind != model.ChatKindDirect {
+		return false
+	}
+	log.Logger.Warnf("User [%s] tried to change the members of the direct chat with GUID %s", user, guid)
+	writeError(w, http.StatusConflict, "Members of a direct chat can't change")
+	return true
+}
+
+// readChat - will respond with the chat.
+func (sh *SessionHandler) readChat(w http.ResponseWriter, guid string) {
+	chat, err := sh.db.ReadChat(guid)
+	if err == database.ErrNotFound {
+		writeError(w, http.StatusNotFound, "Bad GUID")
+		return
+	}
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read the chat")
+		return
+	}
+	writeData(w, http.StatusOK, chat)
+}
+
+// updateChat - will change the metadata of the chat and send it to the chat's live session.
+// Only the members allowed to edit the chat can change it.
+func (sh *SessionHandler) updateChat(w http.ResponseWriter, r *http.Request, guid string, user *model.Client) {
+	var request chatUpdateRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+
+	chat, err := sh.db.ReadChat(guid)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read the chat")
+		return
+	}
+	actor, err := sh.db.ReadMember(guid, user.UserID)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read the member")
+		return
+	}
+	if !chat.EditableBy(actor) {
+		log.Logger.Warnf("User [%s] isn't allowed to change the chat with GUID %s", user, guid)
+		sh.auditChat(audit.EventChatUpdated, audit.OutcomeDenied, user, guid, "")
+		writeError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	changed := chat
+	if request.Title != nil {
+		if !validTitle(w, *request.Title) {
+			return
+		}
+		changed.Title = strings.TrimSpace(*request.Title)
+	}
+	if request.Topic != nil {
+		if !validLength(w, "topic", *request.Topic, model.MaxChatTopicLength) {
+			return
+		}
+		changed.Topic = strings.TrimSpace(*request.Topic)
+	}
+	if request.Description != nil {
+		if !validLength(w, "description", *request.Description, model.MaxChatDescriptionLength) {
+			return
+		}
+		changed.Description = strings.TrimSpace(*request.Description)
+	}
+	if request.Avatar != nil {
+		if !validAvatar(w, *request.Avatar) {
+			return
+		}
+		changed.Avatar = strings.TrimSpace(*request.Avatar)
+	}
+
+	if err := sh.db.UpdateChat(changed); err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't change the chat")
+		return
+	}
+	log.Logger.Infof("User [%s] changed the chat with GUID %s", user, guid)
+	sh.auditChat(audit.EventChatUpdated, audit.OutcomeAllowed, user, guid, "")
+	if sess, ok := sh.session(guid); ok {
+		sess.ChangeChat(chat, changed, *user)
+	}
+
+	writeData(w, http.StatusOK, changed)
+}
+
+// listMembers - will respond with all members of the chat.
+func (sh *SessionHandler) listMembers(w http.ResponseWriter, guid string) {
+	members, err := sh.db.ReadChatMembers(guid)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read members")
+		return
+	}
+	writeData(w, http.StatusOK, members)
+}
+
+// addMember - will add a user to the chat and notify the chat's live session.
+// Only the members allowed to edit the chat can add others to it, and read-only members never can.
+func (sh *SessionHandler) addMember(w http.ResponseWriter, r *http.Request, guid string, user *model.Client) {
+	var request memberRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if _, err := strconv.Atoi(request.UserID); err != nil {
+		writeError(w, http.StatusBadRequest, "Bad user ID")
+		return
+	}
+
+	chat, err := sh.db.ReadChat(guid)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read the chat")
+		return
+	}
+	actor, ok := sh.member(w, guid, user.UserID)
+	if !ok {
+		return
+	}
+	if !chat.EditableBy(actor) || actor.Role == model.RoleReadOnly {
+		log.Logger.Warnf("User [%s] isn't allowed to add members to the chat with GUID %s", user, guid)
+		sh.auditChat(audit.EventMemberAdded, audit.OutcomeDenied, user, guid, "member "+request.UserID)
+		writeError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	member, err := sh.db.ReadUser(request.UserID)
+	if err == database.ErrNotFound {
+		writeError(w, http.StatusNotFound, "No such user")
+		return
+	}
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read the user")
+		return
+	}
+
+	added, err := sh.db.AddChatMember(guid, member.UserID)
+	if err == database.ErrBanned {
+		log.Logger.Warnf("User [%s] tried to add [%s], who is banned, to the chat with GUID %s", user, member, guid)
+		sh.auditChat(audit.EventMemberAdded, audit.OutcomeDenied, user, guid, "member "+member.UserID+" is banned")
+		writeError(w, http.StatusForbidden, "The user is banned from the chat")
+		return
+	}
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't add the member")
+		return
+	}
+	if added {
+		log.Logger.Infof("User [%s] added [%s] to the chat with GUID %s", user, member, guid)
+		sh.auditChat(audit.EventMemberAdded, audit.OutcomeAllowed, user, guid, "member "+member.UserID)
+		if sess, ok := sh.session(guid); ok {
+			sess.AddMember(member)
+		}
+	}
+
+	writeData(w, http.StatusOK, member)
+}
+
+// removeMember - will remove a user from the chat and disconnect them from the chat's live session.
+// Members can always leave a chat, while only moderators can kick others, and only members below them.
+func (sh *SessionHandler) removeMember(w http.ResponseWriter, guid, memberID string, user *model.Client) {
+	if memberID != user.UserID {
+		if _, _, ok := sh.moderate(w, guid, memberID, user, audit.EventMemberRemoved); !ok {
+			return
+		}
+	}
+
+	removed, err := sh.db.RemoveChatMember(guid, memberID)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't remove the member")
+		return
+	}
+	if !removed {
+		writeError(w, http.StatusNotFound, "No such member")
+		return
+	}
+	log.Logger.Infof("User [%s] removed [%s] from the chat with GUID %s", user, memberID, guid)
+	sh.auditChat(audit.EventMemberRemoved, audit.OutcomeAllowed, user, guid, "member "+memberID)
+	if sess, ok := sh.session(guid); ok {
+		sess.RemoveMember(model.Client{UserID: memberID})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// auditChat - will record a chat management event performed by the user.
+func (sh *SessionHandler) auditChat(event, outcome string, user *model.Client, guid, details string) {
+	sh.auditor.Record(model.AuditRecord{
+		Event:    event,
+		ActorID:  user.UserID,
+		ChatGUID: guid,
+		IP:       user.IP,
+		Outcome:  outcome,
+		Details:  details,
+	})
+}
+
+// decodeRequest - will decode the request's JSON body, responding with an error if it's malformed.
+func decodeRequest(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(request); err != nil {
+		writeError(w, http.StatusBadRequest, "Malformed request body")
+		return false
+	}
+	return true
+}
+
+// validTitle - will check the chat title, responding with an error if it's not valid.
+func validTitle(w http.ResponseWriter, title string) bool {
+	title = strings.TrimSpace(title)
+	if title == "" || !utf8.ValidString(title) || utf8.RuneCountInString(title) > model.MaxChatTitleLength {
+		writeError(w, http.StatusBadRequest, "Bad title")
+		return false
+	}
+	return true
+}
+
+// validLength - will check that the text is no longer than max characters, responding with an error if it is.
+func validLength(w http.ResponseWriter, name, text string, max int) bool {
+	if !utf8.ValidString(text) || utf8.RuneCountInString(strings.TrimSpace(text)) > max {
+		writeError(w, http.StatusBadRequest, "Bad "+name)
+		return false
+	}
+	return true
+}
+
+// validAvatar - will check that the avatar is either empty or an absolute http(s) URL,
+// responding with an error if it's not.
+func validAvatar(w http.ResponseWriter, avatar string) bool {
+	avatar = strings.TrimSpace(avatar)
+	if avatar == "" {
+		return true
+	}
+	u, err := url.Parse(avatar)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(avatar) > model.MaxChatAvatarLength {
+		writeError(w, http.StatusBadRequest, "Bad avatar")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,194 @@
+package seshandler
+
+import (
+	"github.com/gorilla/websocket"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidAvatar(t *testing.T) {
+	tests := []struct {
+		avatar string
+		want   bool
+	}{
+		{"", true},
+		{"https://cdn.example.com/avatars/1.png", true},
+		{" http://example.com/a.png ", true},
+		{"ftp://example.com/a.png", false},
+		{"/avatars/1.png", false},
+		{"javascript:alert(1)", false},
+		{"https://", false},
+	}
+
+	for _, tt := range tests {
+		if got := validAvatar(httptest.NewRecorder(), tt.avatar); got != tt.want {
+			t.Errorf("Got %v for avatar %q, want %v", got, tt.avatar, tt.want)
+		}
+	}
+}
+
+func TestChatRoute(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"guid", "{guid}"},
+		{"guid/members", "{guid}/members"},
+		{"guid/members/7", "{guid}/members/{userId}"},
+		{"guid/members/7/mute", "{guid}/members/{userId}/mute"},
+		{"guid/members/7/role", "{guid}/members/{userId}/role"},
+		{"guid/bans/7", "{guid}/bans/{userId}"},
+		{"guid/members/7/avatar", ""},
+		{"guid/bans/7/role", ""},
+		{"guid/other", ""},
+	}
+
+	for _, tt := range tests {
+		if got := chatRoute(strings.Split(tt.path, "/")); got != tt.want {
+			t.Errorf("Got route %q for %q, want %q", got, tt.path, tt.want)
+		}
+	}
+}
+
+// TestDirectChat - a direct chat is created once for both of its users, and never with oneself.
+func TestDirectChat(t *testing.T) {
+	sh := newStoreHandler(&fakeStore{})
+
+	tests := []struct {
+		userID     string
+		target     string
+		wantStatus int
+		wantGUID   string
+	}{
+		{"1", "/chats/direct/1", http.StatusBadRequest, ""},
+		{"1", "/chats/direct/01", http.StatusBadRequest, ""},
+		{"1", "/chats/direct/+1", http.StatusBadRequest, ""},
+		{"1", "/chats/direct/someone", http.StatusBadRequest, ""},
+		{"1", "/chats/direct/100", http.StatusNotFound, ""},
+		{"1", "/chats/direct/2", http.StatusCreated, "direct-1:2"},
+		{"1", "/chats/direct/2", http.StatusOK, "direct-1:2"},
+		{"2", "/chats/direct/1", http.StatusOK, "direct-1:2"},
+		{"2", "/chats/direct/3", http.StatusCreated, "direct-2:3"},
+	}
+
+	for _, tt := range tests {
+		var chat model.Chat
+		status := serve(t, sh.HandleChats, http.MethodPut, tt.target, tt.userID, "", &chat)
+		if status != tt.wantStatus || chat.GUID != tt.wantGUID {
+			t.Errorf("Got status %v and chat %q for %s by %s, want %v and %q",
+				status, chat.GUID, tt.target, tt.userID, tt.wantStatus, tt.wantGUID)
+			continue
+		}
+		if tt.wantGUID != "" && (chat.Peer == nil || "/chats/direct/"+chat.Peer.UserID != tt.target) {
+			t.Errorf("Got peer %+v for %s by %s, want the user requested", chat.Peer, tt.target, tt.userID)
+		}
+	}
+}
+
+// TestCreateChat - a created chat is listed for its creator, who owns it.
+func TestCreateChat(t *testing.T) {
+	sh := newStoreHandler(&fakeStore{})
+
+	if status := serve(t, sh.HandleChats, http.MethodPost, "/chats", "1", `{"title": " "}`, nil); status != http.StatusBadRequest {
+		t.Errorf("Got status %v for a blank title, want %v", status, http.StatusBadRequest)
+	}
+
+	var chat model.Chat
+	if status := serve(t, sh.HandleChats, http.MethodPost, "/chats", "1", `{"title": " Team "}`, &chat); status != http.StatusCreated {
+		t.Fatalf("Got status %v, want %v", status, http.StatusCreated)
+	}
+	if chat.GUID == "" || chat.Title != "Team" || chat.CreatedBy != "1" {
+		t.Errorf("Got chat %+v, want a GUID, the trimmed title and the creator", chat)
+	}
+
+	var chats []model.Chat
+	if status := serve(t, sh.HandleChats, http.MethodGet, "/chats", "1", "", &chats); status != http.StatusOK {
+		t.Fatalf("Got status %v, want %v", status, http.StatusOK)
+	}
+	if len(chats) != 1 || chats[0].GUID != chat.GUID {
+		t.Errorf("Got chats %+v, want the created one", chats)
+	}
+
+	var members []model.Member
+	if status := serve(t, sh.HandleChats, http.MethodGet, "/chats/"+chat.GUID+"/members", "1", "", &members); status != http.StatusOK {
+		t.Fatalf("Got status %v, want %v", status, http.StatusOK)
+	}
+	if len(members) != 1 || members[0].UserID != "1" || members[0].Role != model.RoleOwner {
+		t.Errorf("Got members %+v, want the creator as the owner", members)
+	}
+}
+
+// TestMembershipPushed - members added and removed are announced in the chat's live session,
+// and a removed member is disconnected from it.
+func TestMembershipPushed(t *testing.T) {
+	store := &fakeStore{owner: "1", members: newMembers(model.RoleOwner, model.RoleMember)}
+	sh := newStoreHandler(store)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.URL.Query().Get("user")
+		sh.addToSession(w, r, "g", &model.Client{UserID: user, Username: "user" + user})
+	}))
+	defer server.Close()
+
+	observer := dialSession(t, server, "1")
+	defer observer.Close()
+	removed := dialSession(t, server, "2")
+	defer removed.Close()
+	if sess, ok := sh.session("g"); ok {
+		defer sess.Close()
+	}
+
+	if status := serve(t, sh.HandleChats, http.MethodPost, "/chats/g/members", "1", `{"userId": "3"}`, nil); status != http.StatusOK {
+		t.Fatalf("Got status %v when adding, want %v", status, http.StatusOK)
+	}
+	if membership := nextMembership(t, observer); membership.Client.UserID != "3" || !membership.IsMember {
+		t.Errorf("Got [%s] with membership %v, want user 3 added", membership.Client, membership.IsMember)
+	}
+
+	if status := serve(t, sh.HandleChats, http.MethodDelete, "/chats/g/members/2", "1", "", nil); status != http.StatusNoContent {
+		t.Fatalf("Got status %v when removing, want %v", status, http.StatusNoContent)
+	}
+	if membership := nextMembership(t, observer); membership.Client.UserID != "2" || membership.IsMember {
+		t.Errorf("Got [%s] with membership %v, want user 2 removed", membership.Client, membership.IsMember)
+	}
+
+	_ = removed.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if err := removed.ReadJSON(&model.Payload{}); err != nil {
+			if _, closed := err.(*websocket.CloseError); !closed {
+				t.Errorf("Error when reading %v, want the connection closed", err)
+			}
+			break
+		}
+	}
+}
+
+// dialSession - will open a WebSocket to the test server as the given user and read the initial frame.
+func dialSession(t *testing.T, server *httptest.Server, user string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?user=" + user
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Error when dialing %v, want none", err)
+	}
+	if err := conn.ReadJSON(&model.Payload{}); err != nil {
+		t.Fatalf("Error when reading %v, want none", err)
+	}
+	return conn
+}
+
+// nextMembership - will read frames until a membership notification arrives.
+func nextMembership(t *testing.T, conn *websocket.Conn) model.MembershipNotification {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		payload := model.Payload{}
+		if err := conn.ReadJSON(&payload); err != nil {
+			t.Fatalf("Error when reading %v, want a membership notification", err)
+		}
+		if payload.Membership != nil && payload.Membership.Client != nil {
+			return *payload.Membership
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package seshandler
+
+import (
+	"gitlab.starlink.ua/high-school-prod/chat/server/session"
+	"net/http"
+)
+
+// HandleStream - will stream the chat given by guid as Server-Sent Events, for clients that can't use WebSocket.
+// Clients authenticate with the token query parameter, like on /chat, since EventSource can't send headers.
+func (sh *SessionHandler) HandleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	guid, client, ok := sh.admit(w, r)
+	if !ok {
+		return
+	}
+
+	entry := sh.acquire(guid)
+	if entry == nil {
+		writeError(w, http.StatusServiceUnavailable, "Server is shutting down")
+		return
+	}
+	defer sh.release(guid, entry)
+
+	entry.sess.Stream(w, r, client)
+}
+
+// HandlePoll - will respond with the frames of the chat given by guid that the client didn't get yet,
+// waiting for them if there are none, for clients that can use neither WebSocket nor Server-Sent Events.
+func (sh *SessionHandler) HandlePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	guid, client, ok := sh.admit(w, r)
+	if !ok {
+		return
+	}
+
+	entry := sh.acquire(guid)
+	if entry == nil {
+		writeError(w, http.StatusServiceUnavailable, "Server is shutting down")
+		return
+	}
+	defer sh.release(guid, entry)
+
+	frames, err := entry.sess.Poll(r, client)
+	if err == session.ErrClosed {
+		writeError(w, http.StatusServiceUnavailable, "Chat session is closing, poll again")
+		return
+	}
+	writeData(w, http.StatusOK, frames)
+}
+
+// HandleSend - will handle a frame posted to the chat given by guid, by clients that stream or poll,
+// responding with the frames answering it, such as the ack of a message.
+func (sh *SessionHandler) HandleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	guid, client, ok := sh.admit(w, r)
+	if !ok {
+		return
+	}
+
+	entry := sh.acquire(guid)
+	if entry == nil {
+		writeError(w, http.StatusServiceUnavailable, "Server is shutting down")
+		return
+	}
+	defer sh.release(guid, entry)
+
+	writeData(w, http.StatusOK, entry.sess.Post(r, client))
+}
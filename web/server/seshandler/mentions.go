@@ -0,0 +1,82 @@
+package seshandler
+
+import (
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Limits of the unread mentions listed at once.
+const (
+	defaultMentionsLimit = 50
+	maxMentionsLimit     = 500
+)
+
+// readMentionsRequest - a body of the request marking mentions as read.
+type readMentionsRequest struct {
+	UpToID int64 `json:"upToId"`
+}
+
+// HandleMentions - will serve the mentions of the user:
+//
+//	GET  /mentions        - list the unread mentions in the chats of the user, newest first, up to the limit query parameter
+//	POST /mentions/read   - mark the mentions up to and including upToId as read
+func (sh *SessionHandler) HandleMentions(w http.ResponseWriter, r *http.Request) {
+	userID, _, err := authenticate(r)
+	if err != nil {
+		log.Logger.Warnf("Couldn't verify token: err [%s], dropping request...", err)
+		writeError(w, http.StatusUnauthorized, "Bad token")
+		return
+	}
+
+	switch path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/mentions"), "/"); {
+	case path == "" && r.Method == http.MethodGet:
+		sh.listMentions(w, r, userID)
+	case path == "read" && r.Method == http.MethodPost:
+		sh.readMentions(w, r, userID)
+	case path == "" || path == "read":
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// listMentions - will respond with the unread mentions of the user.
+func (sh *SessionHandler) listMentions(w http.ResponseWriter, r *http.Request, userID string) {
+	limit := defaultMentionsLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxMentionsLimit {
+			writeError(w, http.StatusBadRequest, "Bad limit")
+			return
+		}
+	}
+
+	mentions, err := sh.db.ReadUnreadMentions(userID, limit)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read mentions")
+		return
+	}
+	writeData(w, http.StatusOK, mentions)
+}
+
+// readMentions - will mark the mentions of the user as read.
+func (sh *SessionHandler) readMentions(w http.ResponseWriter, r *http.Request, userID string) {
+	var request readMentionsRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if request.UpToID <= 0 {
+		writeError(w, http.StatusBadRequest, "Bad mention ID")
+		return
+	}
+
+	if _, err := sh.db.MarkMentionsRead(userID, request.UpToID); err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't mark mentions as read")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,275 @@
+package seshandler
+
+import (
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/audit"
+	"gitlab.starlink.ua/high-school-prod/chat/server/database"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxBanReasonLength - the maximum length of the reason of a ban, in characters.
+const maxBanReasonLength = 500
+
+// roleRequest - a body of the request changing the role of a member.
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+// muteRequest - a body of the request muting a member, with a duration like "30s", "10m" or "2h".
+type muteRequest struct {
+	Duration string `json:"duration"`
+}
+
+// banRequest - a body of the request banning a user.
+type banRequest struct {
+	UserID string `json:"userId"`
+	Reason string `json:"reason"`
+}
+
+// moderate - will check that the user may moderate the member of the chat, responding with an error if not.
+// Returns the user's and the moderated member. Denials are audited as the event.
+func (sh *SessionHandler) moderate(w http.ResponseWriter, guid, memberID string, user *model.Client,
+	event string) (actor, target model.Member, ok bool) {
+	if actor, ok = sh.member(w, guid, user.UserID); !ok {
+		return actor, target, false
+	}
+	target, err := sh.db.ReadMember(guid, memberID)
+	if err == database.ErrNotFound {
+		writeError(w, http.StatusNotFound, "No such member")
+		return actor, target, false
+	}
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read the member")
+		return actor, target, false
+	}
+
+	if !model.CanModerate(actor.Role, target.Role) {
+		log.Logger.Warnf("User [%s] isn't allowed to moderate [%s] in the chat with GUID %s", user, target.Client, guid)
+		sh.auditChat(event, audit.OutcomeDenied, user, guid, "member "+memberID)
+		writeError(w, http.StatusForbidden, "Forbidden")
+		return actor, target, false
+	}
+	return actor, target, true
+}
+
+// moderator - will check that the user moderates the chat, responding with an error if not.
+// Denials are audited as the event, unless it's empty.
+func (sh *SessionHandler) moderator(w http.ResponseWriter, guid string, user *model.Client, event, details string) bool {
+	actor, ok := sh.member(w, guid, user.UserID)
+	if !ok {
+		return false
+	}
+	if !model.IsModerator(actor.Role) {
+		log.Logger.Warnf("User [%s] isn't a moderator of the chat with GUID %s", user, guid)
+		if event != "" {
+			sh.auditChat(event, audit.OutcomeDenied, user, guid, details)
+		}
+		writeError(w, http.StatusForbidden, "Forbidden")
+		return false
+	}
+	return true
+}
+
+// member - will read the member of the chat, responding with an error if it fails.
+func (sh *SessionHandler) member(w http.ResponseWriter, guid, userID string) (model.Member, bool) {
+	member, err := sh.db.ReadMember(guid, userID)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read the member")
+		return member, false
+	}
+	return member, true
+}
+
+// setRole - will give the member a role below the user's own, and announce it in the chat's live session.
+// Ownership can't be given away.
+func (sh *SessionHandler) setRole(w http.ResponseWriter, r *http.Request, guid, memberID string, user *model.Client) {
+	var request roleRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if !model.ValidRole(request.Role) || request.Role == model.RoleOwner {
+		writeError(w, http.StatusBadRequest, "Bad role")
+		return
+	}
+
+	actor, target, ok := sh.moderate(w, guid, memberID, user, audit.EventRoleChanged)
+	if !ok {
+		return
+	}
+	details := "member " + memberID + " role " + request.Role
+	if !model.CanModerate(actor.Role, request.Role) {
+		log.Logger.Warnf("User [%s] isn't allowed to give the role %s in the chat with GUID %s", user, request.Role, guid)
+		sh.auditChat(audit.EventRoleChanged, audit.OutcomeDenied, user, guid, details)
+		writeError(w, http.StatusForbidden, "Forbidden")
+		return
+	}
+
+	if _, err := sh.db.SetMemberRole(guid, memberID, request.Role); err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't change the role")
+		return
+	}
+	log.Logger.Infof("User [%s] made [%s] %s in the chat with GUID %s", user, target.Client, request.Role, guid)
+	sh.auditChat(audit.EventRoleChanged, audit.OutcomeAllowed, user, guid, details)
+	if sess, ok := sh.session(guid); ok {
+		sess.ChangeRole(target.Client, request.Role, *user)
+	}
+
+	target.Role = request.Role
+	writeData(w, http.StatusOK, target)
+}
+
+// muteMember - will keep the member from posting for the duration, and announce it in the chat's live session.
+func (sh *SessionHandler) muteMember(w http.ResponseWriter, r *http.Request, guid, memberID string, user *model.Client) {
+	var request muteRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	duration, err := time.ParseDuration(request.Duration)
+	if err != nil || duration <= 0 || duration > model.MaxMuteDuration {
+		writeError(w, http.StatusBadRequest, "Bad duration")
+		return
+	}
+
+	_, target, ok := sh.moderate(w, guid, memberID, user, audit.EventMemberMuted)
+	if !ok {
+		return
+	}
+	until := time.Now().Add(duration).UTC()
+	if _, err := sh.db.MuteMember(guid, memberID, &until); err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't mute the member")
+		return
+	}
+	log.Logger.Infof("User [%s] muted [%s] until %s in the chat with GUID %s", user, target.Client, until, guid)
+	sh.auditChat(audit.EventMemberMuted, audit.OutcomeAllowed, user, guid, "member "+memberID+" until "+until.Format(time.RFC3339))
+	if sess, ok := sh.session(guid); ok {
+		sess.Mute(target.Client, &until, *user)
+	}
+
+	target.MutedUntil = &until
+	writeData(w, http.StatusOK, target)
+}
+
+// unmuteMember - will let the muted member post again, and announce it in the chat's live session.
+func (sh *SessionHandler) unmuteMember(w http.ResponseWriter, guid, memberID string, user *model.Client) {
+	_, target, ok := sh.moderate(w, guid, memberID, user, audit.EventMemberUnmuted)
+	if !ok {
+		return
+	}
+	if _, err := sh.db.MuteMember(guid, memberID, nil); err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't unmute the member")
+		return
+	}
+	log.Logger.Infof("User [%s] unmuted [%s] in the chat with GUID %s", user, target.Client, guid)
+	sh.auditChat(audit.EventMemberUnmuted, audit.OutcomeAllowed, user, guid, "member "+memberID)
+	if sess, ok := sh.session(guid); ok {
+		sess.Mute(target.Client, nil, *user)
+	}
+
+	target.MutedUntil = nil
+	writeData(w, http.StatusOK, target)
+}
+
+// listBans - will respond with the bans of the chat. Only moderators see them.
+func (sh *SessionHandler) listBans(w http.ResponseWriter, guid string, user *model.Client) {
+	if !sh.moderator(w, guid, user, "", "") {
+		return
+	}
+	bans, err := sh.db.ReadChatBans(guid)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read bans")
+		return
+	}
+	writeData(w, http.StatusOK, bans)
+}
+
+// banMember - will remove the user from the chat, closing their connections to the chat's live session,
+// and keep them from joining or being added again. Members can only be banned by moderators above them.
+func (sh *SessionHandler) banMember(w http.ResponseWriter, r *http.Request, guid string, user *model.Client) {
+	var request banRequest
+	if !decodeRequest(w, r, &request) {
+		return
+	}
+	if _, err := strconv.Atoi(request.UserID); err != nil || request.UserID == user.UserID {
+		writeError(w, http.StatusBadRequest, "Bad user ID")
+		return
+	}
+	request.Reason = strings.TrimSpace(request.Reason)
+	if utf8.RuneCountInString(request.Reason) > maxBanReasonLength {
+		writeError(w, http.StatusBadRequest, "Bad reason")
+		return
+	}
+
+	details := "member " + request.UserID
+	target, err := sh.db.ReadMember(guid, request.UserID)
+	switch {
+	case err == database.ErrNotFound:
+		// Users who aren't members can be banned in advance.
+		if !sh.moderator(w, guid, user, audit.EventMemberBanned, details) {
+			return
+		}
+		if target.Client, err = sh.db.ReadUser(request.UserID); err == database.ErrNotFound {
+			writeError(w, http.StatusNotFound, "No such user")
+			return
+		}
+		if err != nil {
+			log.Logger.Error(err)
+			writeError(w, http.StatusInternalServerError, "Couldn't read the user")
+			return
+		}
+	case err != nil:
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't read the member")
+		return
+	default:
+		if _, _, ok := sh.moderate(w, guid, request.UserID, user, audit.EventMemberBanned); !ok {
+			return
+		}
+	}
+
+	ban := model.Ban{UserID: request.UserID, BannedBy: user.UserID, Reason: request.Reason, CreatedAt: time.Now().UTC()}
+	if err := sh.db.BanMember(guid, ban); err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't ban the user")
+		return
+	}
+	log.Logger.Infof("User [%s] banned [%s] from the chat with GUID %s", user, target.Client, guid)
+	sh.auditChat(audit.EventMemberBanned, audit.OutcomeAllowed, user, guid, details)
+	if sess, ok := sh.session(guid); ok {
+		sess.RemoveMember(target.Client)
+	}
+
+	writeData(w, http.StatusCreated, ban)
+}
+
+// unbanMember - will let the user be added to the chat again. Only moderators can lift bans.
+func (sh *SessionHandler) unbanMember(w http.ResponseWriter, guid, userID string, user *model.Client) {
+	details := "member " + userID
+	if !sh.moderator(w, guid, user, audit.EventMemberUnbanned, details) {
+		return
+	}
+	unbanned, err := sh.db.UnbanMember(guid, userID)
+	if err != nil {
+		log.Logger.Error(err)
+		writeError(w, http.StatusInternalServerError, "Couldn't lift the ban")
+		return
+	}
+	if !unbanned {
+		writeError(w, http.StatusNotFound, "No such ban")
+		return
+	}
+	log.Logger.Infof("User [%s] lifted the ban of [%s] in the chat with GUID %s", user, userID, guid)
+	sh.auditChat(audit.EventMemberUnbanned, audit.OutcomeAllowed, user, guid, details)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,139 @@
+package seshandler
+
+import (
+	"gitlab.starlink.ua/high-school-prod/chat/server/audit"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// recordingSink - a sink that keeps the records written to it.
+type recordingSink struct {
+	mu      sync.Mutex
+	records []model.AuditRecord
+}
+
+func (s *recordingSink) Write(record model.AuditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+// newMembers - will return the members of a chat by their IDs, with the roles given in that order from the ID 1.
+func newMembers(roles ...string) map[string]model.Member {
+	members := make(map[string]model.Member)
+	for i, role := range roles {
+		id := string(rune('1' + i))
+		members[id] = model.Member{Client: model.Client{UserID: id, Username: "user" + id}, Role: role}
+	}
+	return members
+}
+
+// TestModerationPermissions - members change roles, mute, ban and add others only as their roles allow,
+// and every denial is audited.
+func TestModerationPermissions(t *testing.T) {
+	store := &fakeStore{owner: "1", members: newMembers(
+		model.RoleOwner, model.RoleAdmin, model.RoleAdmin, model.RoleMember, model.RoleMember, model.RoleReadOnly)}
+	sink := &recordingSink{}
+	sh := newStoreHandler(store)
+	sh.auditor = audit.NewWithSinks(sink)
+
+	steps := []struct {
+		userID     string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+	}{
+		// Roles are only given by moderators, to members below them and only below their own role.
+		{"4", http.MethodPut, "/chats/g/members/5/role", `{"role": "admin"}`, http.StatusForbidden},
+		{"2", http.MethodPut, "/chats/g/members/4/role", `{"role": "admin"}`, http.StatusForbidden},
+		{"2", http.MethodPut, "/chats/g/members/3/role", `{"role": "member"}`, http.StatusForbidden},
+		{"2", http.MethodPut, "/chats/g/members/1/role", `{"role": "member"}`, http.StatusForbidden},
+		{"1", http.MethodPut, "/chats/g/members/4/role", `{"role": "owner"}`, http.StatusBadRequest},
+		{"1", http.MethodPut, "/chats/g/members/9/role", `{"role": "member"}`, http.StatusNotFound},
+		{"1", http.MethodPut, "/chats/g/members/3/role", `{"role": "member"}`, http.StatusOK},
+		{"2", http.MethodPut, "/chats/g/members/5/role", `{"role": "read_only"}`, http.StatusOK},
+
+		// Members are muted and unmuted by moderators above them.
+		{"4", http.MethodPut, "/chats/g/members/3/mute", `{"duration": "10m"}`, http.StatusForbidden},
+		{"6", http.MethodPut, "/chats/g/members/4/mute", `{"duration": "10m"}`, http.StatusForbidden},
+		{"2", http.MethodPut, "/chats/g/members/1/mute", `{"duration": "10m"}`, http.StatusForbidden},
+		{"2", http.MethodPut, "/chats/g/members/4/mute", `{"duration": "forever"}`, http.StatusBadRequest},
+		{"2", http.MethodPut, "/chats/g/members/4/mute", `{"duration": "10m"}`, http.StatusOK},
+		{"1", http.MethodPut, "/chats/g/members/2/mute", `{"duration": "1h"}`, http.StatusOK},
+		{"4", http.MethodDelete, "/chats/g/members/4/mute", "", http.StatusForbidden},
+		{"2", http.MethodDelete, "/chats/g/members/4/mute", "", http.StatusOK},
+
+		// Members are banned by moderators above them, users who aren't members yet by any moderator.
+		{"4", http.MethodPost, "/chats/g/bans", `{"userId": "3"}`, http.StatusForbidden},
+		{"4", http.MethodPost, "/chats/g/bans", `{"userId": "50"}`, http.StatusForbidden},
+		{"2", http.MethodPost, "/chats/g/bans", `{"userId": "1"}`, http.StatusForbidden},
+		{"2", http.MethodPost, "/chats/g/bans", `{"userId": "2"}`, http.StatusBadRequest},
+		{"2", http.MethodPost, "/chats/g/bans", `{"userId": "100"}`, http.StatusNotFound},
+		{"2", http.MethodPost, "/chats/g/bans", `{"userId": "3"}`, http.StatusCreated},
+		{"2", http.MethodPost, "/chats/g/bans", `{"userId": "50"}`, http.StatusCreated},
+
+		// Only moderators add members to a chat with an owner, and never the banned ones.
+		{"5", http.MethodPost, "/chats/g/members", `{"userId": "7"}`, http.StatusForbidden},
+		{"4", http.MethodPost, "/chats/g/members", `{"userId": "7"}`, http.StatusForbidden},
+		{"2", http.MethodPost, "/chats/g/members", `{"userId": "3"}`, http.StatusForbidden},
+		{"2", http.MethodPost, "/chats/g/members", `{"userId": "7"}`, http.StatusOK},
+	}
+
+	denials := 0
+	for _, step := range steps {
+		if status := serve(t, sh.HandleChats, step.method, step.target, step.userID, step.body, nil); status != step.wantStatus {
+			t.Errorf("Got status %v for %s %s %s by %s, want %v",
+				status, step.method, step.target, step.body, step.userID, step.wantStatus)
+		}
+		if step.wantStatus == http.StatusForbidden {
+			denials++
+		}
+	}
+
+	sh.auditor.Close()
+	denied := 0
+	for _, record := range sink.records {
+		if record.Outcome == audit.OutcomeDenied {
+			denied++
+		}
+	}
+	if denied != denials {
+		t.Errorf("Audited %v denials, want %v", denied, denials)
+	}
+
+	tests := []struct {
+		userID    string
+		wantRole  string
+		wantMuted bool
+	}{
+		{"2", model.RoleAdmin, true},
+		{"3", "", false},
+		{"4", model.RoleMember, false},
+		{"5", model.RoleReadOnly, false},
+		{"7", model.RoleMember, false},
+	}
+	for _, tt := range tests {
+		member := store.members[tt.userID]
+		if member.Role != tt.wantRole || (member.MutedUntil != nil) != tt.wantMuted {
+			t.Errorf("Got member %s with role %q muted until %v, want role %q and muted %v",
+				tt.userID, member.Role, member.MutedUntil, tt.wantRole, tt.wantMuted)
+		}
+	}
+}
+
+// TestAddMemberWithoutOwner - any member adds others to a chat that predates the chats table and has no owner.
+func TestAddMemberWithoutOwner(t *testing.T) {
+	store := &fakeStore{members: newMembers(model.RoleMember)}
+	sh := newStoreHandler(store)
+
+	if status := serve(t, sh.HandleChats, http.MethodPost, "/chats/g/members", "1", `{"userId": "2"}`, nil); status != http.StatusOK {
+		t.Errorf("Got status %v, want %v", status, http.StatusOK)
+	}
+	if _, ok := store.members["2"]; !ok {
+		t.Errorf("Member wasn't added")
+	}
+}
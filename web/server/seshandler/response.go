@@ -0,0 +1,79 @@
+package seshandler
+
+import (
+	"encoding/json"
+	"errors"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Response - a response of the chat's REST API, shaped the same way as the user API's responses.
+type Response struct {
+	Ok        bool           `json:"ok"`
+	Timestamp string         `json:"timestamp,omitempty"`
+	Data      interface{}    `json:"data,omitempty"`
+	Error     *ResponseError `json:"error,omitempty"`
+}
+
+// ResponseError - describes why a request failed.
+type ResponseError struct {
+	Message string `json:"message,omitempty"`
+}
+
+// writeData - will write a successful response with the given data.
+func writeData(w http.ResponseWriter, status int, data interface{}) {
+	writeResponse(w, status, &Response{
+		Ok:        true,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Data:      data,
+	})
+}
+
+// writeError - will write a failed response with the given error message.
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeResponse(w, status, &Response{
+		Ok:        false,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Error:     &ResponseError{Message: message},
+	})
+}
+
+// writeResponse - will encode the response as JSON.
+func writeResponse(w http.ResponseWriter, status int, response *Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Logger.Error(err)
+	}
+}
+
+// authenticate - will fetch the user identified by the request's Authorization header.
+func authenticate(r *http.Request) (userID string, username string, err error) {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		return "", "", errors.New("missing Authorization header")
+	}
+	resp, err := fetchUser(token)
+	if err != nil {
+		return "", "", err
+	}
+	return strconv.Itoa(resp.Data.User.ID), resp.Data.User.Username, nil
+}
+
+// isAdmin - will check whether the user is listed in ADMIN_USER_IDS.
+func isAdmin(userID string) bool {
+	if userID == "" {
+		return false
+	}
+	adminIDs, _ := os.LookupEnv("ADMIN_USER_IDS")
+	for _, adminID := range strings.Split(adminIDs, ",") {
+		if strings.TrimSpace(adminID) == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -4,50 +4,130 @@
 package seshandler
 
 import (
+	"context"
 	"github.com/gorilla/websocket"
 	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/audit"
+	"gitlab.starlink.ua/high-school-prod/chat/server/config"
 	"gitlab.starlink.ua/high-school-prod/chat/server/database"
+	"gitlab.starlink.ua/high-school-prod/chat/server/mentions"
 	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/presence"
+	"gitlab.starlink.ua/high-school-prod/chat/server/ratelimit"
 	"gitlab.starlink.ua/high-school-prod/chat/server/session"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 )
 
-// SessionHandler - contains a map of currently opened sessions and a pointer to the DB
+// Store - the persistence the session handler and its sessions rely on, implemented by the database package.
+type Store interface {
+	session.Store
+	ValidateUserChat(userID, chatGUID string) bool
+	ReadAuditRecords(filter model.AuditFilter) ([]model.AuditRecord, error)
+	ReadUser(userID string) (model.Client, error)
+	CreateChat(title, creatorID string) (model.Chat, error)
+	UpdateChat(chat model.Chat) error
+	ReadUserChats(userID string) ([]model.Chat, error)
+	DirectChat(userID, peerID string) (model.Chat, bool, error)
+	ReadUserDirectChats(userID string) ([]model.Chat, error)
+	AddChatMember(guid, userID string) (bool, error)
+	RemoveChatMember(guid, userID string) (bool, error)
+	SetMemberRole(guid, userID, role string) (bool, error)
+	BanMember(guid string, ban model.Ban) error
+	UnbanMember(guid, userID string) (bool, error)
+	ReadChatBans(guid string) ([]model.Ban, error)
+	ReadUnreadMentions(userID string, limit int) ([]model.Mention, error)
+	MarkMentionsRead(userID string, upToID int64) (int64, error)
+	Close()
+}
+
+// SessionHandler - contains a map of currently opened sessions, a pointer to the DB, the auditor, the presence tracker,
+// the mentions hub, the rate limiter and the message pipeline.
+// The sessions map is shared by all request goroutines, so it's guarded by mu.
 type SessionHandler struct {
-	sessions map[string]*session.Session
-	db       *database.Database
+	mu       sync.Mutex
+	sessions map[string]*sessionEntry
+	db       Store
+	auditor  *audit.Auditor
+	presence *presence.Tracker
+	mentions *mentions.Hub
+	limiter  *ratelimit.Limiter
+	pipeline *session.Pipeline
+	draining bool
+	active   sync.WaitGroup
+}
+
+// sessionEntry - a session with the number of clients using it.
+// A session nobody uses is torn down after a grace period, unless a client joins it in the meantime.
+type sessionEntry struct {
+	sess     *session.Session
+	refs     int
+	teardown *time.Timer
 }
 
 // New - will create a new session handler
 func New() *SessionHandler {
 	log.Logger.Infof("Started Session Handler")
+	db := database.New()
 	handler := &SessionHandler{
-		sessions: make(map[string]*session.Session),
-		db:       database.New(),
+		sessions: make(map[string]*sessionEntry),
+		db:       db,
+		auditor:  audit.New(db),
+		presence: presence.NewTracker(db),
+		mentions: mentions.NewHub(db),
+		limiter:  ratelimit.NewLimiter(),
+		pipeline: session.NewPipeline(),
 	}
 	return handler
 }
 
+// Use - will add the middleware to the pipeline messages of all sessions pass through.
+// Middleware is to be added before the handler serves any requests.
+func (sh *SessionHandler) Use(middleware interface{}) {
+	sh.pipeline.Use(middleware)
+}
+
 // Handle - will validate and distribute incoming requests over the right sessions
 func (sh *SessionHandler) Handle(w http.ResponseWriter, r *http.Request) {
+	// "Upgrading" HTTP request to the WebSocket protocol
+	if upgrade := websocket.IsWebSocketUpgrade(r); upgrade == false {
+		log.Logger.Warnf("WebSocket upgrade not present in the request, dropping connection...")
+		http.Error(w, "Method not allowed. Need upgrade to websockets", http.StatusMethodNotAllowed)
+		return
+	}
+
+	guid, client, ok := sh.admit(w, r)
+	if !ok {
+		return
+	}
+
+	// Add user to the session when successfully validated
+	sh.addToSession(w, r, guid, client)
+}
+
+// admit - will check the request's origin, token and access to the chat given by guid, responding with an error
+// if any of them is wrong. Returns the chat's GUID and the client, and whether the client is admitted.
+func (sh *SessionHandler) admit(w http.ResponseWriter, r *http.Request) (string, *model.Client, bool) {
 	guid := r.URL.Query().Get("guid")
 	token := r.URL.Query().Get("token")
+	ip := audit.ClientIP(r)
 
-	log.Logger.Infof("Received upgrade request from token:%s to guid:%s", token, guid)
+	log.Logger.Infof("Received request from token:%s to guid:%s", token, guid)
 
 	// Check the request's origin
 	if !checkOrigin(r) {
 		log.Logger.Warnf("Couldn't verify origin [%s], dropping connection...", r.Header.Get("Origin"))
+		sh.auditor.Record(model.AuditRecord{
+			Event:    audit.EventOriginRejected,
+			ChatGUID: guid,
+			IP:       ip,
+			Outcome:  audit.OutcomeDenied,
+			Details:  "origin " + r.Header.Get("Origin"),
+		})
 		http.Error(w, "Bad Origin", http.StatusForbidden)
-		return
-	}
-
-	// "Upgrading" HTTP request to the WebSocket protocol
-	if upgrade := websocket.IsWebSocketUpgrade(r); upgrade == false {
-		log.Logger.Warnf("WebSocket upgrade not present in the request, dropping connection...")
-		http.Error(w, "Method not allowed. Need upgrade to websockets", http.StatusMethodNotAllowed)
-		return
+		return guid, nil, false
 	}
 
 	resp, err := fetchUser(token)
@@ -55,8 +135,15 @@ func (sh *SessionHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	// Check that fetching user didn't yield an error
 	if err != nil {
 		log.Logger.Warnf("Couldn't verify token: err [%s], dropping connection...", err)
+		sh.auditor.Record(model.AuditRecord{
+			Event:    audit.EventBadToken,
+			ChatGUID: guid,
+			IP:       ip,
+			Outcome:  audit.OutcomeDenied,
+			Details:  err.Error(),
+		})
 		http.Error(w, "Bad token", http.StatusForbidden)
-		return
+		return guid, nil, false
 	}
 
 	userID, username := strconv.Itoa(resp.Data.User.ID), resp.Data.User.Username
@@ -64,34 +151,148 @@ func (sh *SessionHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	// Check that user has access to the given guid
 	if !sh.db.ValidateUserChat(userID, guid) {
 		log.Logger.Warnf("Bad guid [%s] : userID [%s], dropping connection...\n", guid, userID)
+		sh.auditor.Record(model.AuditRecord{
+			Event:    audit.EventBadGUID,
+			ActorID:  userID,
+			ChatGUID: guid,
+			IP:       ip,
+			Outcome:  audit.OutcomeDenied,
+		})
 		http.Error(w, "Bad GUID", http.StatusForbidden)
-		return
+		return guid, nil, false
 	}
 
 	client := &model.Client{
 		UserID:   userID,
 		Username: username,
+		IP:       ip,
 	}
-
-	// Add user to the session when successfully validated
-	sh.addToSession(w, r, guid, client)
+	return guid, client, true
 }
 
-// handleSession - method to add a user to an existing or new session, deletes the session after use
+// addToSession - method to add a user to an existing or new session, releases the session after use
 func (sh *SessionHandler) addToSession(w http.ResponseWriter, r *http.Request, guid string, client *model.Client) {
-	sess, ok := sh.sessions[guid]
+	entry := sh.acquire(guid)
+	if entry == nil {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer sh.release(guid, entry)
+
+	entry.sess.UpgradeAndHandle(w, r, client)
+}
+
+// acquire - will return the session of the chat, creating it if needed, and count one more reference to it.
+// Returns nil if the handler is draining
+func (sh *SessionHandler) acquire(guid string) *sessionEntry {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.draining {
+		return nil
+	}
 
 	// Create a new session or use the existing one
+	entry, ok := sh.sessions[guid]
 	if !ok {
-		sess = session.New(guid, sh.db)
-		sh.sessions[guid] = sess
+		entry = &sessionEntry{sess: session.New(guid, sh.db, sh.auditor, sh.presence, sh.limiter, sh.mentions, sh.pipeline)}
+		sh.sessions[guid] = entry
+	}
+
+	// Cancel the pending teardown, if any. If the teardown is already running, it will see the reference and back off.
+	if entry.teardown != nil {
+		entry.teardown.Stop()
+		entry.teardown = nil
 	}
+	entry.refs++
+	sh.active.Add(1)
+
+	return entry
+}
 
-	deleteSession := sess.UpgradeAndHandle(w, r, client)
+// release - will drop a reference to the session, scheduling its teardown after SESSION_GRACE_PERIOD if it was the last one
+func (sh *SessionHandler) release(guid string, entry *sessionEntry) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	defer sh.active.Done()
 
-	// Delete current session if deleteSession is true
-	if deleteSession {
-		delete(sh.sessions, sess.GUID)
-		log.Logger.Infof("Deleting session with GUID %v", sess.GUID)
+	entry.refs--
+	if entry.refs > 0 {
+		return
 	}
+
+	gracePeriod := config.Duration("SESSION_GRACE_PERIOD", 10*time.Second)
+	entry.teardown = time.AfterFunc(gracePeriod, func() {
+		sh.mu.Lock()
+		if entry.refs > 0 || sh.sessions[guid] != entry {
+			sh.mu.Unlock()
+			return
+		}
+		delete(sh.sessions, guid)
+		sh.mu.Unlock()
+
+		log.Logger.Infof("Deleting session with GUID %v", guid)
+		entry.sess.Close()
+	})
+}
+
+// session - will return the live session of the chat, if there is one
+func (sh *SessionHandler) session(guid string) (*session.Session, bool) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	entry, ok := sh.sessions[guid]
+	if !ok {
+		return nil, false
+	}
+	return entry.sess, true
+}
+
+// Drain - will stop admitting clients and close every session, telling the clients that the server is going away,
+// then wait until all of them are gone or ctx is done
+func (sh *SessionHandler) Drain(ctx context.Context) error {
+	sh.mu.Lock()
+	sh.draining = true
+	sessions := make([]*session.Session, 0, len(sh.sessions))
+	for _, entry := range sh.sessions {
+		sessions = append(sessions, entry.sess)
+	}
+	sh.mu.Unlock()
+
+	log.Logger.Infof("Draining %v sessions", len(sessions))
+
+	done := make(chan struct{})
+	go func() {
+		var closing sync.WaitGroup
+		for _, sess := range sessions {
+			closing.Add(1)
+			go func(sess *session.Session) {
+				defer closing.Done()
+				sess.GoAway()
+			}(sess)
+		}
+		closing.Wait()
+		sh.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush - will announce that the users of this instance went offline and flush the pending audit records,
+// leaving the DB open for the clients and requests still being served
+func (sh *SessionHandler) Flush() {
+	sh.presence.Close()
+	sh.auditor.Close()
+}
+
+// Close - will flush and close the DB. Meant to be called once the handler is drained and no requests are served,
+// since whatever still uses the DB fails once it's closed
+func (sh *SessionHandler) Close() {
+	sh.Flush()
+	sh.db.Close()
 }
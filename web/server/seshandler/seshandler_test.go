@@ -0,0 +1,339 @@
+package seshandler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/database"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/presence"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.Logger.SetOutput(ioutil.Discard)
+
+	// The user API knows every numeric token as the user with that ID.
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.Header.Get("Authorization"))
+		if err != nil {
+			fmt.Fprint(w, `{"ok": false, "error": {"message": "bad token"}}`)
+			return
+		}
+		fmt.Fprintf(w, `{"ok": true, "data": {"user": {"id": %v, "username": "user%v"}}}`, id, id)
+	}))
+	os.Setenv("API_BASE_URL", api.URL)
+
+	code := m.Run()
+	api.Close()
+	os.Exit(code)
+}
+
+// fakeStore - an in-memory Store. Methods a test doesn't need panic, through the embedded nil Store.
+type fakeStore struct {
+	Store
+	mu      sync.Mutex
+	records []model.AuditRecord
+	chats   map[string]model.Chat
+	owner   string
+	groups  []model.Chat
+	members map[string]model.Member
+	bans    map[string]model.Ban
+}
+
+// CreateChat - will create a group chat with the creator as its owner and only member, the members of the store
+// are then the chat's.
+func (s *fakeStore) CreateChat(title, creatorID string) (model.Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chat := model.Chat{
+		GUID:      "group-" + strconv.Itoa(len(s.groups)+1),
+		Kind:      model.ChatKindGroup,
+		Title:     title,
+		CreatedBy: creatorID,
+	}
+	s.groups = append(s.groups, chat)
+	s.owner = creatorID
+	s.members = map[string]model.Member{
+		creatorID: {Client: model.Client{UserID: creatorID, Username: "user" + creatorID}, Role: model.RoleOwner},
+	}
+	return chat, nil
+}
+
+func (s *fakeStore) ReadUserChats(userID string) ([]model.Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chats := make([]model.Chat, 0)
+	for _, chat := range s.groups {
+		if chat.CreatedBy == userID {
+			chats = append(chats, chat)
+		}
+	}
+	return chats, nil
+}
+
+func (s *fakeStore) ReadChatMembers(guid string) ([]model.Member, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := make([]model.Member, 0, len(s.members))
+	for _, member := range s.members {
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+func (s *fakeStore) RemoveChatMember(guid, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.members[userID]
+	delete(s.members, userID)
+	return ok, nil
+}
+
+// ReadRecentMessages - will return no messages, the store keeps none.
+func (s *fakeStore) ReadRecentMessages(guid string, numMsgs int, pageToken string) model.Payload {
+	return model.Payload{Messages: make([]model.Message, 0)}
+}
+
+// ReadUser - will return the user with the ID, users below 100 exist. The ID is normalized, like the DB does.
+func (s *fakeStore) ReadUser(userID string) (model.Client, error) {
+	id, err := strconv.Atoi(userID)
+	if err != nil || id >= 100 {
+		return model.Client{}, database.ErrNotFound
+	}
+	userID = strconv.Itoa(id)
+	return model.Client{UserID: userID, Username: "user" + userID}, nil
+}
+
+func (s *fakeStore) DirectChat(userID, peerID string) (model.Chat, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if peerID < userID {
+		userID, peerID = peerID, userID
+	}
+	key := userID + ":" + peerID
+	if chat, ok := s.chats[key]; ok {
+		return chat, false, nil
+	}
+	if s.chats == nil {
+		s.chats = make(map[string]model.Chat)
+	}
+	chat := model.Chat{GUID: "direct-" + key, Kind: model.ChatKindDirect, CreatedBy: userID}
+	s.chats[key] = chat
+	return chat, true, nil
+}
+
+// ReadChat - will return the group chat created by the owner, whatever the GUID.
+func (s *fakeStore) ReadChat(guid string) (model.Chat, error) {
+	return model.Chat{GUID: guid, Kind: model.ChatKindGroup, CreatedBy: s.owner}, nil
+}
+
+func (s *fakeStore) ReadMember(guid, userID string) (model.Member, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	member, ok := s.members[userID]
+	if !ok {
+		return member, database.ErrNotFound
+	}
+	return member, nil
+}
+
+func (s *fakeStore) AddChatMember(guid, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.bans[userID]; ok {
+		return false, database.ErrBanned
+	}
+	if _, ok := s.members[userID]; ok {
+		return false, nil
+	}
+	s.members[userID] = model.Member{Client: model.Client{UserID: userID}, Role: model.RoleMember}
+	return true, nil
+}
+
+func (s *fakeStore) SetMemberRole(guid, userID, role string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	member, ok := s.members[userID]
+	member.Role = role
+	s.members[userID] = member
+	return ok, nil
+}
+
+func (s *fakeStore) MuteMember(guid, userID string, until *time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	member, ok := s.members[userID]
+	member.MutedUntil = until
+	s.members[userID] = member
+	return ok, nil
+}
+
+func (s *fakeStore) BanMember(guid string, ban model.Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bans == nil {
+		s.bans = make(map[string]model.Ban)
+	}
+	s.bans[ban.UserID] = ban
+	delete(s.members, ban.UserID)
+	return nil
+}
+
+func (s *fakeStore) ValidateUserChat(userID, chatGUID string) bool {
+	return true
+}
+
+func (s *fakeStore) ReadAuditRecords(filter model.AuditFilter) ([]model.AuditRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]model.AuditRecord, 0)
+	for i := len(s.records) - 1; i >= 0 && len(records) < filter.Limit; i-- {
+		record := s.records[i]
+		if (filter.Event == "" || record.Event == filter.Event) && (filter.BeforeID == 0 || record.ID < filter.BeforeID) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// newStoreHandler - will construct a session handler on top of the store, enough for serving the REST API.
+func newStoreHandler(store Store) *SessionHandler {
+	return &SessionHandler{
+		sessions: make(map[string]*sessionEntry),
+		db:       store,
+		presence: presence.NewTracker(nil),
+	}
+}
+
+// serve - will serve the request made by the user with the handler, decoding the response's data into data
+// unless it's nil. Returns the response's status.
+func serve(t *testing.T, handler http.HandlerFunc, method, target, userID, body string, data interface{}) int {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, target, reader)
+	r.Header.Set("Authorization", userID)
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	if data != nil && w.Code < http.StatusBadRequest {
+		if err := json.NewDecoder(w.Body).Decode(&Response{Data: data}); err != nil {
+			t.Fatalf("Error when decoding %v, want none", err)
+		}
+	}
+	return w.Code
+}
+
+// newTestHandler - will construct a session handler without a DB, enough for managing sessions.
+func newTestHandler(gracePeriod string) *SessionHandler {
+	os.Setenv("SESSION_GRACE_PERIOD", gracePeriod)
+	return &SessionHandler{
+		sessions: make(map[string]*sessionEntry),
+		presence: presence.NewTracker(nil),
+	}
+}
+
+func TestSessionReusedWithinGracePeriod(t *testing.T) {
+	sh := newTestHandler("1h")
+	defer os.Unsetenv("SESSION_GRACE_PERIOD")
+
+	first := sh.acquire("guid")
+	sh.release("guid", first)
+	second := sh.acquire("guid")
+
+	if first != second {
+		t.Errorf("Got a new session, want the one released within the grace period")
+	}
+	if second.refs != 1 || second.teardown != nil {
+		t.Errorf("Session has %v references and teardown %v, want 1 and none", second.refs, second.teardown)
+	}
+
+	sh.release("guid", second)
+	second.teardown.Stop()
+	second.sess.Close()
+}
+
+func TestSessionTornDownAfterGracePeriod(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	sh := newTestHandler("10ms")
+	defer os.Unsetenv("SESSION_GRACE_PERIOD")
+
+	first := sh.acquire("guid")
+	second := sh.acquire("guid")
+	sh.release("guid", first)
+
+	// A session still in use is never torn down.
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := sh.session("guid"); !ok {
+		t.Fatalf("Session was torn down while in use")
+	}
+
+	sh.release("guid", second)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := sh.session("guid"); !ok && runtime.NumGoroutine() <= baseline {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Session wasn't torn down: %v goroutines running, want at most %v", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A client joining afterwards gets a fresh session.
+	third := sh.acquire("guid")
+	if third == second {
+		t.Errorf("Got the torn down session, want a new one")
+	}
+	third.refs = 0
+	third.sess.Close()
+}
+
+func TestDrainWaitsForClients(t *testing.T) {
+	sh := newTestHandler("1h")
+	defer os.Unsetenv("SESSION_GRACE_PERIOD")
+
+	entry := sh.acquire("guid")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		sh.release("guid", entry)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := sh.Drain(ctx); err != nil {
+		t.Fatalf("Error when draining %v, want none", err)
+	}
+
+	// A drained handler admits nobody.
+	if entry := sh.acquire("guid"); entry != nil {
+		t.Errorf("Acquired a session while drained, want none")
+	}
+}
+
+func TestDrainGivesUpAtDeadline(t *testing.T) {
+	sh := newTestHandler("1h")
+	defer os.Unsetenv("SESSION_GRACE_PERIOD")
+
+	entry := sh.acquire("guid")
+	defer sh.release("guid", entry)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := sh.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Error when draining %v, want %v", err, context.DeadlineExceeded)
+	}
+}
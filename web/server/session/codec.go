@@ -0,0 +1,55 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// codec - encodes frames for the wire and decodes them back. A connection uses the codec of the protocol it negotiated,
+// so that the rest of the session doesn't care about the encoding.
+type codec interface {
+	// messageType - the WebSocket message type frames are sent as.
+	messageType() int
+	marshal(v interface{}) ([]byte, error)
+	unmarshal(data []byte, v interface{}) error
+}
+
+// jsonCodec - encodes frames as JSON text.
+type jsonCodec struct{}
+
+func (jsonCodec) messageType() int {
+	return websocket.TextMessage
+}
+
+func (jsonCodec) marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackCodec - encodes frames as MessagePack binary, with the same field names as JSON.
+type msgpackCodec struct{}
+
+func (msgpackCodec) messageType() int {
+	return websocket.BinaryMessage
+}
+
+func (msgpackCodec) marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) unmarshal(data []byte, v interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
@@ -0,0 +1,221 @@
+package session
+
+import (
+	"fmt"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxNicknameLength - the maximum length of a nickname, in characters.
+const maxNicknameLength = 32
+
+// command - a slash command, run in place of saving the message it was sent as.
+// run returns false if the client is not to be served any longer, like a handler does.
+type command struct {
+	usage       string
+	description string
+	run         func(session *Session, call *commandCall) bool
+}
+
+// commandCall - an invocation of a command by a client, with the arguments following the command's name.
+type commandCall struct {
+	conn      *connection
+	client    *model.Client
+	requestID string
+	msg       model.Message
+	name      string
+	args      string
+}
+
+// commands - the registry of commands by their names.
+var commands map[string]command
+
+// The registry is filled in on init, since /help lists it.
+func init() {
+	commands = map[string]command{
+		"help":   {"/help", "list the commands", (*Session).runHelp},
+		"me":     {"/me <action>", "say that you are doing something", (*Session).runMe},
+		"topic":  {"/topic [topic]", "change the topic of the chat, or clear it", (*Session).runTopic},
+		"nick":   {"/nick [nickname]", "change the name you go by in the chat, or go back to your username", (*Session).runNick},
+		"mute":   {"/mute <name> [duration]", "keep a member from posting, for 10m by default", (*Session).runMute},
+		"unmute": {"/unmute <name>", "let a muted member post again", (*Session).runUnmute},
+	}
+}
+
+// runCommand - will parse the message as a command and run it. Unknown commands are rejected.
+func (session *Session) runCommand(conn *connection, requestID string, msg model.Message) bool {
+	name, args := msg.Text[1:], ""
+	if i := strings.IndexFunc(name, unicode.IsSpace); i >= 0 {
+		name, args = name[:i], strings.TrimSpace(name[i:])
+	}
+	name = strings.ToLower(name)
+
+	cmd, ok := commands[name]
+	if !ok {
+		conn.nack(requestID, model.ReasonInvalid, fmt.Sprintf("unknown command /%s, see /help", name))
+		return true
+	}
+	log.Logger.Infof("Client [%s] runs command /%s in the chat with GUID %s", conn.client, name, session.GUID)
+	return cmd.run(session, &commandCall{conn: conn, client: conn.client, requestID: requestID, msg: msg, name: name, args: args})
+}
+
+// reply - will acknowledge the command and tell the result to the client who ran it only.
+func (call *commandCall) reply(session *Session, text string) {
+	call.conn.ack(call.requestID, model.Message{})
+	call.conn.enqueue(model.TypeMessage, &model.Payload{Messages: []model.Message{session.systemMessage(text)}})
+}
+
+// reject - will tell the client who ran the command why it failed.
+func (call *commandCall) reject(reason, details string) {
+	call.conn.nack(call.requestID, reason, details)
+}
+
+// systemMessage - will make a message from the server to the chat. System messages aren't saved.
+func (session *Session) systemMessage(text string) model.Message {
+	return model.Message{
+		Timestamp: time.Now().UTC().Format(timestampLayout),
+		Text:      text,
+		ChatGUID:  session.GUID,
+		Kind:      model.MessageKindSystem,
+	}
+}
+
+// announce - will send a system message to all clients of the session.
+func (session *Session) announce(text string) {
+	payload := &model.Payload{Messages: []model.Message{session.systemMessage(text)}}
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	for c := range session.clients {
+		c.enqueue(model.TypeMessage, payload)
+	}
+}
+
+// runHelp - will list the commands to the client.
+func (session *Session) runHelp(call *commandCall) bool {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s - %s", commands[name].usage, commands[name].description))
+	}
+	call.reply(session, strings.Join(lines, "\n"))
+	return true
+}
+
+// runMe - will post the action as a message of its own kind.
+func (session *Session) runMe(call *commandCall) bool {
+	if call.args == "" {
+		call.reject(model.ReasonEmpty, "usage: "+commands[call.name].usage)
+		return true
+	}
+	msg := call.msg
+	msg.Text = call.args
+	msg.Kind = model.MessageKindAction
+	return session.post(call.conn, call.requestID, msg)
+}
+
+// runTopic - will change the topic of the chat and announce it, if the client may edit the chat.
+func (session *Session) runTopic(call *commandCall) bool {
+	if length := utf8.RuneCountInString(call.args); length > model.MaxChatTopicLength {
+		call.reject(model.ReasonTooLong, fmt.Sprintf("topic of %v characters, want at most %v", length, model.MaxChatTopicLength))
+		return true
+	}
+	chat, err := session.db.ReadChat(session.GUID)
+	if err != nil {
+		log.Logger.Error(err)
+		call.reject(model.ReasonInternal, "")
+		return true
+	}
+	member, err := session.db.ReadMember(session.GUID, call.client.UserID)
+	if err != nil {
+		log.Logger.Error(err)
+		call.reject(model.ReasonInternal, "")
+		return true
+	}
+	if !chat.EditableBy(member) {
+		call.reject(model.ReasonForbidden, "only moderators can change the topic of the chat")
+		return true
+	}
+	if err := session.db.SetChatTopic(session.GUID, call.args); err != nil {
+		log.Logger.Error(err)
+		call.reject(model.ReasonInternal, "")
+		return true
+	}
+
+	call.conn.ack(call.requestID, model.Message{})
+	changed := chat
+	changed.Topic = call.args
+	session.ChangeChat(chat, changed, *call.client)
+	return true
+}
+
+// runNick - will change the name the member goes by in the chat and announce it.
+// A nickname is a single word, without the leading @ of a mention, that no other member goes by,
+// whether as a username or as a nickname, ignoring case.
+func (session *Session) runNick(call *commandCall) bool {
+	nickname := call.args
+	if strings.IndexFunc(nickname, unicode.IsSpace) >= 0 || strings.HasPrefix(nickname, "@") ||
+		utf8.RuneCountInString(nickname) > maxNicknameLength {
+		call.reject(model.ReasonInvalid, fmt.Sprintf("a nickname is a single word of at most %v characters", maxNicknameLength))
+		return true
+	}
+	if nickname != "" {
+		members, err := session.db.ReadChatMembers(session.GUID)
+		if err != nil {
+			log.Logger.Error(err)
+			call.reject(model.ReasonInternal, "")
+			return true
+		}
+		for _, member := range members {
+			if member.UserID != call.client.UserID &&
+				(strings.EqualFold(member.Username, nickname) || strings.EqualFold(member.Nickname, nickname)) {
+				call.reject(model.ReasonInvalid, fmt.Sprintf("another member goes by %s", nickname))
+				return true
+			}
+		}
+	}
+
+	previous := session.displayName(call.client)
+	if err := session.db.SetNickname(session.GUID, call.client.UserID, nickname); err != nil {
+		log.Logger.Error(err)
+		call.reject(model.ReasonInternal, "")
+		return true
+	}
+	session.nickMu.Lock()
+	session.nicknames[call.client.UserID] = nickname
+	session.nickMu.Unlock()
+
+	call.conn.ack(call.requestID, model.Message{})
+	session.announce(fmt.Sprintf("%s is now known as %s", previous, session.displayName(call.client)))
+	return true
+}
+
+// displayName - will return the nickname the client goes by in the chat, or the username if there's none.
+// Nicknames are read from the DB once per session.
+func (session *Session) displayName(client *model.Client) string {
+	session.nickMu.Lock()
+	defer session.nickMu.Unlock()
+
+	nickname, ok := session.nicknames[client.UserID]
+	if !ok {
+		var err error
+		if nickname, err = session.db.ReadNickname(session.GUID, client.UserID); err != nil {
+			log.Logger.Error(err)
+			return client.Username
+		}
+		session.nicknames[client.UserID] = nickname
+	}
+	if nickname == "" {
+		return client.Username
+	}
+	return nickname
+}
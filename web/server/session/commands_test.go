@@ -0,0 +1,152 @@
+package session
+
+import (
+	"github.com/gorilla/websocket"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/presence"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextMessage - will read frames until one carrying a message arrives and return the message.
+func nextMessage(t *testing.T, conn *websocket.Conn) model.Message {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		payload := model.Payload{}
+		if err := conn.ReadJSON(&payload); err != nil {
+			t.Fatalf("Error when reading %v, want a message", err)
+		}
+		if payload.Ack == nil && payload.SeqFrom == 0 && payload.PageSize == 0 && len(payload.Messages) == 1 {
+			return payload.Messages[0]
+		}
+	}
+}
+
+// TestCommands - commands change the state of the chat and are announced instead of being saved as text.
+func TestCommands(t *testing.T) {
+	store := &fakeStore{}
+	sess := New("test-guid", store, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	observer := dial(t, server, "observer")
+	defer observer.Close()
+	sender := dial(t, server, "1")
+	defer sender.Close()
+
+	tests := []struct {
+		text string
+		want model.Message
+	}{
+		{"/nick Al", model.Message{Kind: model.MessageKindSystem, Text: "user1 is now known as Al"}},
+		{"/ME waves", model.Message{Kind: model.MessageKindAction, Text: "waves", UserID: "1", Username: "Al"}},
+		{"/topic Release  plans", model.Message{Kind: model.MessageKindSystem, Text: "Al changed the topic to: Release  plans"}},
+		{"//shrug", model.Message{Text: "/shrug", UserID: "1", Username: "Al"}},
+		{"/nick", model.Message{Kind: model.MessageKindSystem, Text: "Al is now known as user1"}},
+	}
+	for _, tt := range tests {
+		if err := sender.WriteJSON(&model.Payload{Messages: []model.Message{{Text: tt.text}}}); err != nil {
+			t.Fatalf("Error when writing %v, want none", err)
+		}
+		got := nextMessage(t, observer)
+		if got.Kind != tt.want.Kind || got.Text != tt.want.Text || got.UserID != tt.want.UserID || got.Username != tt.want.Username {
+			t.Errorf("Got %+v for %q, want %+v", got, tt.text, tt.want)
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.chat.Topic != "Release  plans" {
+		t.Errorf("Got topic %q, want %q", store.chat.Topic, "Release  plans")
+	}
+	if len(store.msgs) != 2 {
+		t.Errorf("Saved %v messages, want only the action and the escaped one", len(store.msgs))
+	}
+}
+
+// TestCommandRepliesArePrivate - help is only sent to the client who asked, and unknown commands are rejected.
+func TestCommandRepliesArePrivate(t *testing.T) {
+	sess := New("test-guid", &fakeStore{}, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	observer := dial(t, server, "observer")
+	defer observer.Close()
+	sender := dial(t, server, "1")
+	defer sender.Close()
+
+	for _, text := range []string{"/help", "/bogus", "/me", "done"} {
+		if err := sender.WriteJSON(&model.Payload{RequestID: text, Messages: []model.Message{{Text: text}}}); err != nil {
+			t.Fatalf("Error when writing %v, want none", err)
+		}
+	}
+
+	acks := make(map[string]model.Ack)
+	var help model.Message
+	_ = sender.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(acks) < 4 || help.Text == "" {
+		payload := model.Payload{}
+		if err := sender.ReadJSON(&payload); err != nil {
+			t.Fatalf("Error when reading %v, want acks and help", err)
+		}
+		if payload.Ack != nil {
+			acks[payload.Ack.RequestID] = *payload.Ack
+		}
+		for _, msg := range payload.Messages {
+			if msg.Kind == model.MessageKindSystem {
+				help = msg
+			}
+		}
+	}
+	if !acks["/help"].OK || acks["/bogus"].Reason != model.ReasonInvalid || acks["/me"].Reason != model.ReasonEmpty || !acks["done"].OK {
+		t.Errorf("Got acks %+v, want /help and done accepted, /bogus invalid and /me empty", acks)
+	}
+	if !strings.Contains(help.Text, "/topic [topic]") {
+		t.Errorf("Got help %q, want the commands listed", help.Text)
+	}
+
+	// The observer only gets the plain message.
+	if got := nextMessage(t, observer); got.Text != "done" {
+		t.Errorf("Observer got %+v, want the message sent after the commands", got)
+	}
+}
+
+// TestNicknamesUnique - a member can't go by the username or the nickname of another member, whatever the case.
+func TestNicknamesUnique(t *testing.T) {
+	store := &fakeStore{members: []model.Member{
+		{Client: model.Client{UserID: "1", Username: "user1"}, Role: model.RoleMember},
+		{Client: model.Client{UserID: "2", Username: "user2"}, Role: model.RoleMember},
+	}}
+	sess := New("test-guid", store, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	first := dial(t, server, "1")
+	defer first.Close()
+	second := dial(t, server, "2")
+	defer second.Close()
+
+	steps := []struct {
+		conn   *websocket.Conn
+		text   string
+		reason string
+	}{
+		{first, "/nick User2", model.ReasonInvalid},
+		{first, "/nick Al", ""},
+		{second, "/nick al", model.ReasonInvalid},
+		{second, "/nick AL", model.ReasonInvalid},
+		{first, "/nick USER1", ""},
+		{second, "/nick Al", ""},
+		{first, "/nick", ""},
+	}
+	for i, step := range steps {
+		ack := send(t, step.conn, string(rune('a'+i)), step.text)
+		if ack.OK != (step.reason == "") || ack.Reason != step.reason {
+			t.Errorf("Got ack %+v for %q, want reason %q", ack, step.text, step.reason)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package session
+
+import (
+	"github.com/gorilla/websocket"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/config"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/ratelimit"
+	"sync"
+	"time"
+)
+
+// Overflow policies - what happens when a client's outbound queue is full.
+const (
+	// OverflowDisconnect - the slow client is disconnected.
+	OverflowDisconnect = "disconnect"
+	// OverflowDrop - the payload that didn't fit is dropped, the client stays connected.
+	OverflowDrop = "drop"
+)
+
+// connection - a client's connection with its own outbound queue, drained by its own writer goroutine
+// onto the connection's wire. All writes go through the queue, so there's never more than one concurrent writer.
+// A connection without a wire has no writer: whoever serves the client takes the frames from the queue.
+//
+// The writer pings the client every pingInterval, and the reader gives up if neither a pong nor any other frame
+// arrives within pongWait. If idleTimeout is set, a client that sends no payloads for that long is disconnected too.
+// Only WebSocket clients are read from, so only they are checked for pongs and idleness.
+//
+// The writer doesn't start draining the queue until the connection is opened, so that the initial payload
+// can be written first. Live messages already contained in the initial payload are skipped.
+type connection struct {
+	conn         *websocket.Conn
+	wire         wire
+	client       *model.Client
+	protocol     protocol
+	limit        *ratelimit.Bucket
+	unsubscribe  func()
+	send         chan *outbound
+	ready        chan struct{}
+	openOnce     sync.Once
+	initialSeq   int64
+	overflow     string
+	writeWait    time.Duration
+	pingInterval time.Duration
+	pongWait     time.Duration
+	idleTimeout  time.Duration
+	idle         *time.Timer
+	closeCode    int
+	closeText    string
+	closeMu      sync.Mutex
+	closed       chan struct{}
+	closeOnce    sync.Once
+	stopped      chan struct{}
+}
+
+// newConnection - will construct a connection using SEND_QUEUE_SIZE, SEND_OVERFLOW_POLICY, WRITE_WAIT,
+// PING_INTERVAL, PONG_WAIT and IDLE_TIMEOUT, limiting its messages by RATE_LIMIT_CONNECTION.
+func newConnection(conn *websocket.Conn, client *model.Client) *connection {
+	c := newQueuedConnection(nil, client)
+	c.conn = conn
+	c.protocol = negotiated(conn.Subprotocol())
+	c.wire = &wsWire{conn: conn, protocol: c.protocol, writeWait: c.writeWait}
+	c.pongWait = config.Duration("PONG_WAIT", 60*time.Second)
+	c.idleTimeout = config.Duration("IDLE_TIMEOUT", 0)
+
+	// Pings must be sent more often than pongs are awaited, or healthy clients would be reaped.
+	if c.pingInterval >= c.pongWait {
+		c.pingInterval = c.pongWait * 9 / 10
+	}
+
+	return c
+}
+
+// newQueuedConnection - will construct the connection of a client that isn't connected by WebSocket.
+// Frames are written to the wire, if there is one, and otherwise left in the queue for the caller to take.
+func newQueuedConnection(w wire, client *model.Client) *connection {
+	return &connection{
+		wire:         w,
+		client:       client,
+		protocol:     untypedProtocol,
+		limit:        ratelimit.NewConnectionBucket(),
+		send:         make(chan *outbound, config.Int("SEND_QUEUE_SIZE", 64)),
+		ready:        make(chan struct{}),
+		overflow:     config.String("SEND_OVERFLOW_POLICY", OverflowDisconnect),
+		writeWait:    config.Duration("WRITE_WAIT", 10*time.Second),
+		pingInterval: config.Duration("PING_INTERVAL", 30*time.Second),
+		closeCode:    websocket.CloseNormalClosure,
+		closed:       make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+}
+
+// start - will start the connection's writer, accounting for it in wg, and arm the liveness checks.
+func (c *connection) start(wg *sync.WaitGroup) {
+	if c.conn != nil {
+		c.conn.SetReadLimit(maxFrameSize())
+		c.extendReadDeadline()
+		c.conn.SetPongHandler(func(string) error {
+			c.extendReadDeadline()
+			return nil
+		})
+	}
+	if c.idleTimeout > 0 {
+		c.idle = time.AfterFunc(c.idleTimeout, func() {
+			log.Logger.Infof("Client [%s] has been idle for %v, disconnecting", c.client, c.idleTimeout)
+			c.closeWith(websocket.CloseNormalClosure, "idle timeout")
+		})
+	}
+	if c.wire == nil {
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.writePump()
+	}()
+}
+
+// read - will read the next frame from the client, keeping the connection alive.
+// Frames of the untyped protocol are typed by their fields.
+// A frame that isn't well-formed results in a malformedError, after which reading can go on.
+func (c *connection) read(envelope *model.Envelope) error {
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	c.extendReadDeadline()
+	if c.idle != nil {
+		c.idle.Reset(c.idleTimeout)
+	}
+
+	if err := c.protocol.codec.unmarshal(data, envelope); err != nil {
+		return &malformedError{err}
+	}
+	if c.protocol.version == 0 {
+		envelope.Type = untypedFrameType(&envelope.Payload)
+	}
+	return nil
+}
+
+// extendReadDeadline - will give the client another pongWait to show it's alive.
+func (c *connection) extendReadDeadline() {
+	if err := c.conn.SetReadDeadline(time.Now().Add(c.pongWait)); err != nil {
+		log.Logger.Error(err)
+	}
+}
+
+// outbound - a payload queued for sending, with its frame type. A live message carries its sequence number.
+type outbound struct {
+	frameType string
+	payload   *model.Payload
+	seq       int64
+}
+
+// skip - will tell whether the outbound payload is a live message the client already got with the initial payload.
+func (c *connection) skip(out *outbound) bool {
+	return out.seq > 0 && out.seq <= c.initialSeq
+}
+
+// writeInitial - will write the payload the client gets first, directly, before the connection is opened.
+// Live messages up to the newest one in the payload won't be sent again.
+func (c *connection) writeInitial(payload *model.Payload) error {
+	for _, msg := range payload.Messages {
+		if msg.Seq > c.initialSeq {
+			c.initialSeq = msg.Seq
+		}
+	}
+	return c.wire.write(model.TypeHistory, payload)
+}
+
+// open - will let the writer start draining the queue.
+func (c *connection) open() {
+	c.openOnce.Do(func() {
+		close(c.ready)
+	})
+}
+
+// enqueue - will queue the payload for sending without blocking.
+// Returns false if the payload didn't fit into the queue.
+func (c *connection) enqueue(frameType string, payload *model.Payload) bool {
+	return c.enqueueOutbound(&outbound{frameType: frameType, payload: payload})
+}
+
+// enqueueLive - will queue a live message for sending without blocking.
+func (c *connection) enqueueLive(frameType string, payload *model.Payload, seq int64) bool {
+	return c.enqueueOutbound(&outbound{frameType: frameType, payload: payload, seq: seq})
+}
+
+// enqueueOutbound - will queue the outbound payload without blocking, applying the overflow policy if it doesn't fit.
+// A nil outbound payload is a request to close the connection.
+func (c *connection) enqueueOutbound(out *outbound) bool {
+	select {
+	case <-c.closed:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- out:
+		return true
+	default:
+	}
+
+	if c.overflow == OverflowDrop {
+		log.Logger.Warnf("Outbound queue of client [%s] is full, dropping payload", c.client)
+	} else {
+		log.Logger.Warnf("Outbound queue of client [%s] is full, disconnecting", c.client)
+		c.close()
+	}
+	return false
+}
+
+// ack - will tell the client that the message it sent with the request ID was saved.
+func (c *connection) ack(requestID string, msg model.Message) {
+	c.enqueue(model.TypeAck, &model.Payload{Ack: &model.Ack{RequestID: requestID, OK: true, ID: msg.ID, Seq: msg.Seq}})
+}
+
+// nack - will tell the client that the message it sent with the request ID was rejected, and why.
+func (c *connection) nack(requestID, reason, details string) {
+	c.enqueue(model.TypeAck, &model.Payload{Ack: &model.Ack{RequestID: requestID, Reason: reason, Details: details}})
+}
+
+// closeAfterFlush - will close the connection once the payloads queued so far are sent.
+func (c *connection) closeAfterFlush() {
+	c.closeWith(websocket.CloseNormalClosure, "")
+}
+
+// closeWith - will close the connection with the given close frame once the payloads queued so far are sent.
+func (c *connection) closeWith(code int, text string) {
+	c.closeMu.Lock()
+	c.closeCode, c.closeText = code, text
+	c.closeMu.Unlock()
+
+	if !c.enqueueOutbound(nil) {
+		c.close()
+	}
+}
+
+// close - will close the underlying wire, which also stops the writer and makes the reader fail.
+func (c *connection) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.idle != nil {
+			c.idle.Stop()
+		}
+		if c.wire == nil {
+			return
+		}
+		if err := c.wire.close(); err != nil {
+			log.Logger.Error(err)
+		}
+	})
+}
+
+// A go routine that monitors the outbound queue and writes the payloads to the wire, pinging the client meanwhile.
+// A nil payload is a request to close the connection.
+func (c *connection) writePump() {
+	defer close(c.stopped)
+
+	select {
+	case <-c.closed:
+		return
+	case <-c.ready:
+	}
+
+	ticker := time.NewTicker(c.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+			if err := c.wire.ping(); err != nil {
+				log.Logger.Error(err)
+				c.close()
+				return
+			}
+		case out := <-c.send:
+			if out == nil {
+				c.closeMu.Lock()
+				code, text := c.closeCode, c.closeText
+				c.closeMu.Unlock()
+				_ = c.wire.goodbye(code, text)
+				c.close()
+				return
+			}
+			if c.skip(out) {
+				continue
+			}
+			if err := c.wire.write(out.frameType, out.payload); err != nil {
+				log.Logger.Error(err)
+				c.close()
+				return
+			}
+		}
+	}
+}
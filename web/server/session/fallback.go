@@ -0,0 +1,150 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/config"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// ErrClosed - the session was closed, the client should retry and get a new one.
+var ErrClosed = errors.New("session is closed")
+
+// Stream - will deliver the session's frames to the client as Server-Sent Events until the client goes away,
+// for clients that can't use WebSocket. The client sends with Post. Reconnecting, an EventSource resumes
+// after the last message it got, since the event IDs are sequence numbers.
+func (session *Session) Stream(w http.ResponseWriter, r *http.Request, client *model.Client) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	conn := newQueuedConnection(&sseWire{w: w, flusher: flusher}, client)
+	if !session.join(conn, r) {
+		return
+	}
+
+	select {
+	case <-r.Context().Done():
+	case <-conn.closed:
+	}
+	session.leave(conn)
+
+	// The response can't be written to once the handler returns.
+	<-conn.stopped
+}
+
+// Poll - will return the frames for a client polling the session, for clients that can't use WebSocket
+// or Server-Sent Events. A client presenting the sequence number of the last message it saw as lastSeq
+// gets the messages it missed right away, like a resuming client. Otherwise the poll waits up to POLL_TIMEOUT
+// for frames to arrive. Polling clients aren't counted as present in the chat.
+func (session *Session) Poll(r *http.Request, client *model.Client) ([]model.Envelope, error) {
+	conn := newQueuedConnection(nil, client)
+	if !session.addClient(conn) {
+		return nil, ErrClosed
+	}
+	defer func() {
+		conn.close()
+		session.deleteClient(conn)
+	}()
+
+	lastSeq := requestedLastSeq(r)
+	payload := session.initialPayload(r)
+	if lastSeq == 0 || payload.Resync || len(payload.Messages) > 0 {
+		return []model.Envelope{envelope(model.TypeHistory, &payload)}, nil
+	}
+	conn.initialSeq = lastSeq
+
+	timer := time.NewTimer(config.Duration("POLL_TIMEOUT", 25*time.Second))
+	defer timer.Stop()
+
+	select {
+	case out := <-conn.send:
+		frames := make([]model.Envelope, 0)
+		if out == nil {
+			return frames, nil
+		}
+		if !conn.skip(out) {
+			frames = append(frames, envelope(out.frameType, out.payload))
+		}
+
+		// Return whatever arrived with the first frame, without waiting for more.
+		return append(frames, conn.drain()...), nil
+	case <-timer.C:
+	case <-r.Context().Done():
+	case <-conn.closed:
+	}
+	return make([]model.Envelope, 0), nil
+}
+
+// Post - will handle a frame sent over HTTP, by clients that stream or poll, and return the frames answering it.
+// The frame is the JSON envelope of the typed protocol; an untyped payload is typed by its fields.
+// Each frame is limited per connection on its own, so only the user and chat rate limits apply across posts.
+func (session *Session) Post(r *http.Request, client *model.Client) []model.Envelope {
+	conn := newQueuedConnection(nil, client)
+
+	maxSize := maxFrameSize()
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		log.Logger.Error(err)
+		conn.nack("", model.ReasonInvalid, "unreadable frame")
+		return conn.drain()
+	}
+	if int64(len(data)) > maxSize {
+		conn.nack("", model.ReasonTooLong, fmt.Sprintf("frame longer than %v bytes", maxSize))
+		return conn.drain()
+	}
+
+	frame := model.Envelope{}
+	if err := conn.protocol.codec.unmarshal(data, &frame); err != nil {
+		log.Logger.Errorf("Client [%s] posted a %s", client, &malformedError{err})
+		conn.nack("", model.ReasonInvalid, "malformed frame")
+		return conn.drain()
+	}
+	if frame.Type == "" {
+		frame.Type = untypedFrameType(&frame.Payload)
+	}
+
+	handle, ok := handlers[frame.Type]
+	if !ok {
+		conn.nack(frame.RequestID, model.ReasonInvalid, fmt.Sprintf("unknown frame type [%s]", frame.Type))
+		return conn.drain()
+	}
+	handle(session, conn, &frame.Payload)
+	return conn.drain()
+}
+
+// drain - will take the frames queued for a connection without a wire, without waiting for more.
+func (c *connection) drain() []model.Envelope {
+	frames := make([]model.Envelope, 0)
+	for {
+		select {
+		case out := <-c.send:
+			if out == nil {
+				return frames
+			}
+			if !c.skip(out) {
+				frames = append(frames, envelope(out.frameType, out.payload))
+			}
+		default:
+			return frames
+		}
+	}
+}
+
+// envelope - will wrap the payload into the envelope of the latest typed protocol.
+func envelope(frameType string, payload *model.Payload) model.Envelope {
+	return model.Envelope{Version: latestVersion, Type: frameType, Payload: *payload}
+}
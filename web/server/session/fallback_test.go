@@ -0,0 +1,169 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/presence"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFallbackServer - will start a server with the HTTP transports of the session,
+// identifying clients by the "user" query parameter.
+func newFallbackServer(sess *Session) *httptest.Server {
+	client := func(r *http.Request) *model.Client {
+		user := r.URL.Query().Get("user")
+		return &model.Client{UserID: user, Username: "user" + user}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		sess.Stream(w, r, client(r))
+	})
+	mux.HandleFunc("/poll", func(w http.ResponseWriter, r *http.Request) {
+		frames, err := sess.Poll(r, client(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(frames)
+	})
+	mux.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(sess.Post(r, client(r)))
+	})
+	return httptest.NewServer(mux)
+}
+
+// post - will post the frame as the user and return the frames answering it.
+func post(t *testing.T, server *httptest.Server, user, frame string) []model.Envelope {
+	resp, err := http.Post(server.URL+"/send?user="+user, "application/json", strings.NewReader(frame))
+	if err != nil {
+		t.Fatalf("Error when posting %v, want none", err)
+	}
+	defer resp.Body.Close()
+	frames := make([]model.Envelope, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&frames); err != nil {
+		t.Fatalf("Error when decoding %v, want none", err)
+	}
+	return frames
+}
+
+// TestStreamAndPost - a client streaming the session gets the messages posted to it, with sequence numbers as event IDs.
+func TestStreamAndPost(t *testing.T) {
+	sess := New("test-guid", &fakeStore{}, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newFallbackServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	resp, err := http.Get(server.URL + "/stream?user=streamer")
+	if err != nil {
+		t.Fatalf("Error when streaming %v, want none", err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Content type [%s], want [text/event-stream]", contentType)
+	}
+
+	// events - every event of the stream, as its lines.
+	events := make(chan []string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		event := make([]string, 0)
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				event = append(event, scanner.Text())
+				continue
+			}
+			events <- event
+			event = make([]string, 0)
+		}
+		close(events)
+	}()
+	next := func() []string {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("Stream ended, want an event")
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No event, want one")
+		}
+		return nil
+	}
+
+	if event := next(); event[0] != "event: history" {
+		t.Errorf("First event %v, want the history", event)
+	}
+
+	frames := post(t, server, "poster", `{"type": "message", "requestId": "1", "messages": [{"text": "hello"}]}`)
+	if len(frames) != 1 || frames[0].Type != model.TypeAck || !frames[0].Ack.OK {
+		t.Errorf("Posting answered with %+v, want a positive ack", frames)
+	}
+
+	// Posting an untyped payload works too.
+	frames = post(t, server, "poster", `{"requestId": "2", "messages": [{"text": " "}]}`)
+	if len(frames) != 1 || frames[0].Type != model.TypeAck || frames[0].Ack.Reason != model.ReasonEmpty {
+		t.Errorf("Posting answered with %+v, want a negative ack", frames)
+	}
+
+	for {
+		event := next()
+		if event[0] == "id: 1" && event[1] == "event: message" && strings.Contains(event[2], "hello") {
+			return
+		}
+	}
+}
+
+// TestPoll - a polling client gets the messages it missed right away, and otherwise waits for new ones.
+func TestPoll(t *testing.T) {
+	store := &fakeStore{}
+	if _, _, err := store.SaveMessage(model.Message{Text: "missed"}); err != nil {
+		t.Fatalf("Error when saving %v, want none", err)
+	}
+	sess := New("test-guid", store, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newFallbackServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	// Polls also run in their own goroutine, so failures don't stop the test here.
+	poll := func(query string) []model.Envelope {
+		frames := make([]model.Envelope, 0)
+		resp, err := http.Get(server.URL + "/poll?user=poller&" + query)
+		if err != nil {
+			t.Errorf("Error when polling %v, want none", err)
+			return frames
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&frames); err != nil {
+			t.Errorf("Error when decoding %v, want none", err)
+		}
+		return frames
+	}
+
+	frames := poll("lastSeq=0")
+	if len(frames) != 1 || frames[0].Type != model.TypeHistory {
+		t.Fatalf("First poll got %+v, want the history", frames)
+	}
+
+	// Nothing was missed, so the poll waits for the next message.
+	// Should the message be posted before the poll starts waiting, the poll gets it as missed.
+	polled := make(chan []model.Envelope)
+	go func() {
+		polled <- poll("lastSeq=1")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	post(t, server, "poster", `{"type": "message", "messages": [{"text": "new"}]}`)
+
+	select {
+	case frames := <-polled:
+		if len(frames) != 1 || len(frames[0].Messages) != 1 || frames[0].Messages[0].Text != "new" {
+			t.Errorf("Poll got %+v, want the new message", frames)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Poll didn't return, want the new message")
+	}
+}
@@ -0,0 +1,195 @@
+package session
+
+import (
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/audit"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/ratelimit"
+	"strings"
+	"time"
+)
+
+// timestampLayout - the layout of the timestamps messages are stamped with.
+const timestampLayout = "01-02-2006 15:04:05.000000 UTC"
+
+// handler - handles a frame of one type sent by a client. Returns false if the client is not to be served any longer.
+type handler func(session *Session, conn *connection, payload *model.Payload) bool
+
+// handlers - the registry of handlers by the type of the frame they handle.
+var handlers = map[string]handler{
+	model.TypePresence: (*Session).handlePresence,
+	model.TypeTyping:   (*Session).handleTyping,
+	model.TypeHistory:  (*Session).handleHistory,
+	model.TypeRange:    (*Session).handleRange,
+	model.TypeMessage:  (*Session).handleMessage,
+}
+
+// handlePresence - will tell whether this device of the user is online or away. Presence updates aren't broadcast.
+func (session *Session) handlePresence(conn *connection, payload *model.Payload) bool {
+	if payload.Notification == nil {
+		conn.nack(payload.RequestID, model.ReasonInvalid, "presence frame without a notification")
+		return true
+	}
+	session.presence.SetState(session.GUID, conn.client.UserID, conn, payload.Notification.State)
+	return true
+}
+
+// handleTyping - will relay a typing indicator to the others. Typing indicators aren't saved.
+func (session *Session) handleTyping(conn *connection, payload *model.Payload) bool {
+	if payload.Typing == nil {
+		conn.nack(payload.RequestID, model.ReasonInvalid, "typing frame without a typing indicator")
+		return true
+	}
+	session.setTyping(*conn.client, payload.Typing.IsTyping)
+	return true
+}
+
+// handleHistory - will respond with the page of messages the page token points to.
+func (session *Session) handleHistory(conn *connection, payload *model.Payload) bool {
+	log.Logger.Infof("Received page token %s", payload.PageToken)
+	page := session.db.ReadRecentMessages(session.GUID, pageSize(payload.PageSize), payload.PageToken)
+	page.RequestID = payload.RequestID
+	conn.enqueue(model.TypeHistory, &page)
+	return true
+}
+
+// handleRange - will respond with the messages in the sequence range, to fill a gap.
+func (session *Session) handleRange(conn *connection, payload *model.Payload) bool {
+	log.Logger.Infof("Received sequence range %v-%v", payload.SeqFrom, payload.SeqTo)
+	if payload.SeqFrom <= 0 {
+		conn.nack(payload.RequestID, model.ReasonInvalid, "range frame without a start")
+		return true
+	}
+	toSeq := payload.SeqTo
+	if toSeq < payload.SeqFrom {
+		toSeq = payload.SeqFrom
+	}
+	page, err := session.db.ReadMessageRange(session.GUID, payload.SeqFrom, toSeq, pageSize(payload.PageSize))
+	if err != nil {
+		log.Logger.Error(err)
+		conn.nack(payload.RequestID, model.ReasonInternal, "")
+		return true
+	}
+	page.RequestID = payload.RequestID
+	conn.enqueue(model.TypeRange, &page)
+	return true
+}
+
+// handleMessage - will save the message and broadcast it to all clients.
+// Every message frame is answered with an ack or a nack, correlated by the client's request ID.
+func (session *Session) handleMessage(conn *connection, payload *model.Payload) bool {
+	client := conn.client
+	requestID := payload.RequestID
+
+	// Messages over the limits of the connection, the user or the chat are rejected, and flooding is punished.
+	if verdict := session.limiter.Check(client.UserID, conn.limit, session.limit); verdict != ratelimit.Allow {
+		conn.nack(requestID, model.ReasonRateLimited, "")
+		session.punish(conn, verdict)
+		return true
+	}
+
+	// Only the server decides the kind and the annotations of a message.
+	if len(payload.Messages) == 1 {
+		ctx := &MessageContext{ChatGUID: session.GUID, Client: *client, Message: payload.Messages[0]}
+		ctx.Message.Kind, ctx.Message.Annotations = "", nil
+		if err := session.pipeline.preValidate(ctx); err != nil {
+			conn.rejectWith(requestID, err)
+			return true
+		}
+		payload.Messages[0] = ctx.Message
+	}
+
+	// If the message is invalid - do not broadcast and do not save to the DB.
+	receivedMsg, ok := session.validate(conn, requestID, payload)
+	if !ok {
+		return true
+	}
+
+	// Transformed messages are validated again, since the hooks may have broken them.
+	ctx := &MessageContext{ChatGUID: session.GUID, Client: *client, Message: receivedMsg}
+	if err := session.pipeline.transform(ctx); err != nil {
+		conn.rejectWith(requestID, err)
+		return true
+	}
+	if receivedMsg, ok = session.validate(conn, requestID, &model.Payload{Messages: []model.Message{ctx.Message}}); !ok {
+		return true
+	}
+
+	// Messages starting with a slash are commands, unless the slash is doubled.
+	if strings.HasPrefix(receivedMsg.Text, "//") {
+		receivedMsg.Text = receivedMsg.Text[1:]
+	} else if strings.HasPrefix(receivedMsg.Text, "/") {
+		return session.runCommand(conn, requestID, receivedMsg)
+	}
+
+	return session.post(conn, requestID, receivedMsg)
+}
+
+// validate - will validate the message in the payload, rejecting it if it's invalid.
+func (session *Session) validate(conn *connection, requestID string, payload *model.Payload) (model.Message, bool) {
+	msg, invalid := validateMessage(payload)
+	if invalid != nil {
+		log.Logger.Errorf("Rejected a message from client [%s] - %s", conn.client, invalid)
+		if invalid.reason == model.ReasonTooLong {
+			session.audit(audit.EventMessageTooLong, audit.OutcomeDenied, conn.client, invalid.details)
+		}
+		conn.nack(requestID, invalid.reason, invalid.details)
+		return msg, false
+	}
+	return msg, true
+}
+
+// post - will stamp the message, save it and broadcast it to all clients, acknowledging it to the sender.
+func (session *Session) post(conn *connection, requestID string, receivedMsg model.Message) bool {
+	client := conn.client
+	if !session.mayPost(conn, requestID) {
+		return true
+	}
+
+	timestamp := time.Now().UTC().Format(timestampLayout)
+	receivedMsg.Timestamp = timestamp
+	receivedMsg.ChatGUID = session.GUID
+	receivedMsg.UserID = client.UserID
+	receivedMsg.Username = session.displayName(client)
+
+	log.Logger.Infof("Message received: %s", receivedMsg)
+
+	ctx := &MessageContext{ChatGUID: session.GUID, Client: *client, Message: receivedMsg}
+	if err := session.pipeline.prePersist(ctx); err != nil {
+		conn.rejectWith(requestID, err)
+		return true
+	}
+
+	// Save the message before broadcasting, so that a resent message is only delivered once.
+	savedMsg, duplicate, err := session.db.SaveMessage(ctx.Message)
+	if err != nil {
+		log.Logger.Error(err)
+		conn.nack(requestID, model.ReasonInternal, "")
+		return true
+	}
+	conn.ack(requestID, savedMsg)
+
+	// Echo the original message back to the sender only, so it can reconcile its view.
+	if duplicate {
+		log.Logger.Infof("Received a duplicate of message with client message ID %s", savedMsg.ClientMsgID)
+		conn.enqueue(model.TypeMessage, &model.Payload{Messages: []model.Message{savedMsg}})
+		return true
+	}
+
+	ctx.Message = savedMsg
+	session.pipeline.postPersist(ctx)
+
+	// Sending a message ends typing it.
+	session.setTyping(*client, false)
+
+	// The hooks have the last word on what the clients get, so the message is delivered as they left it.
+	session.pipeline.preBroadcast(ctx)
+	select {
+	case session.broadcast <- ctx.Message:
+	case <-session.done:
+		return false
+	}
+
+	session.mention(ctx.Message)
+	return true
+}
@@ -0,0 +1,73 @@
+package session
+
+import (
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/config"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"regexp"
+	"strings"
+)
+
+// mentionPattern - matches "@username" that doesn't continue a word, like an email address does.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_])@([\p{L}\p{N}_][\p{L}\p{N}_.-]*)`)
+
+// parseMentions - will return the distinct usernames mentioned in the text, lowercased, up to MAX_MENTIONS of them.
+func parseMentions(text string) []string {
+	max := config.Int("MAX_MENTIONS", 20)
+	usernames := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		// Punctuation right after a mention ends the sentence, not the username.
+		username := strings.ToLower(strings.TrimRight(match[1], ".-"))
+		if seen[username] {
+			continue
+		}
+		if len(usernames) == max {
+			break
+		}
+		seen[username] = true
+		usernames = append(usernames, username)
+	}
+	return usernames
+}
+
+// mention - will record the mentions of the chat's members in the message and notify the mentioned members,
+// wherever they are connected. Members are mentioned by their usernames or their nicknames in the chat,
+// and can't mention themselves.
+func (session *Session) mention(msg model.Message) {
+	usernames := parseMentions(msg.Text)
+	if len(usernames) == 0 {
+		return
+	}
+
+	members, err := session.db.ReadChatMembers(session.GUID)
+	if err != nil {
+		log.Logger.Error(err)
+		return
+	}
+	mentioned := make([]model.Client, 0)
+	for _, member := range members {
+		if member.UserID == msg.UserID {
+			continue
+		}
+		for _, username := range usernames {
+			if strings.ToLower(member.Username) == username || strings.ToLower(member.Nickname) == username {
+				mentioned = append(mentioned, member.Client)
+				break
+			}
+		}
+	}
+	if len(mentioned) == 0 {
+		return
+	}
+
+	mentions, err := session.db.SaveMentions(msg, mentioned)
+	if err != nil {
+		log.Logger.Error(err)
+		return
+	}
+	for _, mention := range mentions {
+		log.Logger.Infof("User with id %s was mentioned in the chat with GUID %s", mention.UserID, session.GUID)
+		session.mentions.Publish(mention)
+	}
+}
@@ -0,0 +1,88 @@
+package session
+
+import (
+	"gitlab.starlink.ua/high-school-prod/chat/server/mentions"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/presence"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"no mentions here", []string{}},
+		{"@alice hi", []string{"alice"}},
+		{"hi @Alice, @bob. and @ALICE again", []string{"alice", "bob"}},
+		{"mail me at me@example.com", []string{}},
+		{"(@j.doe)", []string{"j.doe"}},
+		{"just an @", []string{}},
+	}
+
+	for _, test := range tests {
+		if got := parseMentions(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Got mentions %q in %q, want %q", got, test.text, test.want)
+		}
+	}
+}
+
+// TestMentionDeliveredAcrossChats - a mentioned member is notified on a connection to another chat,
+// while the sender and non-members are not mentioned. Members are mentioned by their nicknames too.
+func TestMentionDeliveredAcrossChats(t *testing.T) {
+	hub := mentions.NewHub(nil)
+	tracker := presence.NewTracker(nil)
+
+	store := &fakeStore{members: []model.Member{
+		{Client: model.Client{UserID: "1", Username: "user1"}, Role: model.RoleMember},
+		{Client: model.Client{UserID: "2", Username: "user2"}, Role: model.RoleMember},
+		{Client: model.Client{UserID: "3", Username: "user3"}, Role: model.RoleMember},
+	}, nicknames: map[string]string{"3": "Charlie"}}
+	chat := New("chat-guid", store, nil, tracker, nil, hub, nil)
+	chatServer := newTestServer(chat)
+	defer chatServer.Close()
+	defer chat.Close()
+
+	other := New("other-guid", &fakeStore{}, nil, tracker, nil, hub, nil)
+	otherServer := newTestServer(other)
+	defer otherServer.Close()
+	defer other.Close()
+
+	mentioned := dial(t, otherServer, "2")
+	defer mentioned.Close()
+	sender := dial(t, chatServer, "1")
+	defer sender.Close()
+
+	// Wait for the mentioned user's connection to be subscribed.
+	_ = mentioned.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := mentioned.ReadJSON(&model.Payload{}); err != nil {
+		t.Fatalf("Error when reading %v, want the initial payload", err)
+	}
+
+	text := "@user1 @User2 @user4 @charlie look"
+	if err := sender.WriteJSON(&model.Payload{Messages: []model.Message{{Text: text}}}); err != nil {
+		t.Fatalf("Error when writing %v, want none", err)
+	}
+
+	for {
+		payload := model.Payload{}
+		if err := mentioned.ReadJSON(&payload); err != nil {
+			t.Fatalf("Error when reading %v, want a mention", err)
+		}
+		if payload.Mention == nil {
+			continue
+		}
+		if payload.Mention.UserID != "2" || payload.Mention.Message.Text != text || payload.Mention.Message.ChatGUID != "chat-guid" {
+			t.Errorf("Got mention %+v, want one of user 2 in the message sent to chat-guid", payload.Mention)
+		}
+		break
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.mentions) != 2 || store.mentions[1].UserID != "3" {
+		t.Errorf("Recorded mentions %+v, want user 2 and user 3, by the nickname", store.mentions)
+	}
+}
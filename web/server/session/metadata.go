@@ -0,0 +1,48 @@
+package session
+
+import (
+	"fmt"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"strings"
+)
+
+// ChangeChat - will send the new metadata of the chat to all clients and announce what the user changed.
+func (session *Session) ChangeChat(before, after model.Chat, by model.Client) {
+	changes := describeChanges(before, after)
+	if len(changes) == 0 {
+		return
+	}
+
+	log.Logger.Infof("Sending the metadata of the chat with GUID %s to all clients", session.GUID)
+	payload := &model.Payload{Chat: &after}
+	session.mu.RLock()
+	for conn := range session.clients {
+		conn.enqueue(model.TypeChat, payload)
+	}
+	session.mu.RUnlock()
+
+	session.announce(fmt.Sprintf("%s %s", session.displayName(&by), strings.Join(changes, ", ")))
+}
+
+// describeChanges - will describe the changes of the chat's metadata for an announcement.
+// Short fields are quoted, the description and the avatar are only mentioned.
+func describeChanges(before, after model.Chat) []string {
+	changes := make([]string, 0)
+	describe := func(field, from, to string, quoted bool) {
+		switch {
+		case from == to:
+		case to == "":
+			changes = append(changes, "cleared the "+field)
+		case quoted:
+			changes = append(changes, fmt.Sprintf("changed the %s to: %s", field, to))
+		default:
+			changes = append(changes, "changed the "+field)
+		}
+	}
+	describe("title", before.Title, after.Title, true)
+	describe("topic", before.Topic, after.Topic, true)
+	describe("description", before.Description, after.Description, false)
+	describe("avatar", before.Avatar, after.Avatar, false)
+	return changes
+}
@@ -0,0 +1,66 @@
+package session
+
+import (
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/presence"
+	"testing"
+	"time"
+)
+
+// TestChatMetadata - joining clients get the metadata of the chat, which only its creator changes,
+// and changes are sent to everybody and announced.
+func TestChatMetadata(t *testing.T) {
+	chat := model.Chat{GUID: "test-guid", Kind: model.ChatKindGroup, Title: "Team", CreatedBy: "owner"}
+	sess := New("test-guid", &fakeStore{chat: chat}, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	conn := dial(t, server, "1")
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	initial := model.Payload{}
+	if err := conn.ReadJSON(&initial); err != nil {
+		t.Fatalf("Error when reading %v, want the initial payload", err)
+	}
+	if initial.Chat == nil || initial.Chat.Title != "Team" {
+		t.Errorf("Got chat %+v in the initial payload, want the chat titled Team", initial.Chat)
+	}
+
+	if err := conn.WriteJSON(&model.Payload{RequestID: "topic", Messages: []model.Message{{Text: "/topic mine"}}}); err != nil {
+		t.Fatalf("Error when writing %v, want none", err)
+	}
+	changed := chat
+	changed.Title, changed.Description = "New", "About the team"
+	sess.ChangeChat(chat, changed, model.Client{UserID: "owner", Username: "boss"})
+
+	var ack *model.Ack
+	var metadata *model.Chat
+	var announcement string
+	for ack == nil || metadata == nil || announcement == "" {
+		payload := model.Payload{}
+		if err := conn.ReadJSON(&payload); err != nil {
+			t.Fatalf("Error when reading %v, want an ack, the metadata and an announcement", err)
+		}
+		if payload.Ack != nil {
+			ack = payload.Ack
+		}
+		if payload.Chat != nil {
+			metadata = payload.Chat
+		}
+		for _, msg := range payload.Messages {
+			announcement = msg.Text
+		}
+	}
+
+	if ack.Reason != model.ReasonForbidden {
+		t.Errorf("Got ack %+v for the topic of a member, want it forbidden", ack)
+	}
+	if metadata.Title != "New" || metadata.Description != "About the team" {
+		t.Errorf("Got metadata %+v, want the changed one", metadata)
+	}
+	if want := "boss changed the title to: New, changed the description"; announcement != want {
+		t.Errorf("Got announcement %q, want %q", announcement, want)
+	}
+}
@@ -0,0 +1,149 @@
+package session
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/audit"
+	"gitlab.starlink.ua/high-school-prod/chat/server/database"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"strings"
+	"time"
+)
+
+// defaultMuteDuration - how long /mute keeps a member from posting if no duration is given.
+const defaultMuteDuration = 10 * time.Minute
+
+// mutedLayout - the layout of the time a member is muted until, in announcements.
+const mutedLayout = "2006-01-02 15:04 MST"
+
+// mayPost - will check that the client's member may post to the chat, rejecting the message if not.
+// Read-only members never may, muted members may once the mute expires. A client who is no longer a member,
+// kicked or banned while connected elsewhere, is disconnected.
+func (session *Session) mayPost(conn *connection, requestID string) bool {
+	member, err := session.db.ReadMember(session.GUID, conn.client.UserID)
+	if err == database.ErrNotFound {
+		log.Logger.Warnf("Client [%s] is no longer a member of the chat with GUID %s, disconnecting", conn.client, session.GUID)
+		conn.nack(requestID, model.ReasonForbidden, "not a member")
+		conn.closeWith(websocket.ClosePolicyViolation, "not a member")
+		return false
+	}
+	if err != nil {
+		log.Logger.Error(err)
+		conn.nack(requestID, model.ReasonInternal, "")
+		return false
+	}
+
+	switch {
+	case member.Role == model.RoleReadOnly:
+		conn.nack(requestID, model.ReasonForbidden, "read-only members can't post")
+	case member.Muted(time.Now()):
+		conn.nack(requestID, model.ReasonMuted, "muted until "+member.MutedUntil.UTC().Format(time.RFC3339))
+	default:
+		return true
+	}
+	log.Logger.Warnf("Rejected a message from client [%s], who may not post to the chat with GUID %s", conn.client, session.GUID)
+	return false
+}
+
+// Mute - will announce that the member was muted until the time, or unmuted if it's nil.
+func (session *Session) Mute(member model.Client, until *time.Time, by model.Client) {
+	if until == nil {
+		session.announce(fmt.Sprintf("%s unmuted %s", session.displayName(&by), session.displayName(&member)))
+		return
+	}
+	session.announce(fmt.Sprintf("%s muted %s until %s", session.displayName(&by), session.displayName(&member),
+		until.UTC().Format(mutedLayout)))
+}
+
+// ChangeRole - will announce that the member was given the role.
+func (session *Session) ChangeRole(member model.Client, role string, by model.Client) {
+	roles := map[string]string{
+		model.RoleOwner:    "an owner",
+		model.RoleAdmin:    "an admin",
+		model.RoleMember:   "a member",
+		model.RoleReadOnly: "read-only",
+	}
+	session.announce(fmt.Sprintf("%s made %s %s", session.displayName(&by), session.displayName(&member), roles[role]))
+}
+
+// runMute - will keep the member from posting for the duration.
+func (session *Session) runMute(call *commandCall) bool {
+	args := strings.Fields(call.args)
+	if len(args) == 0 || len(args) > 2 {
+		call.reject(model.ReasonInvalid, "usage: "+commands[call.name].usage)
+		return true
+	}
+	duration := defaultMuteDuration
+	if len(args) == 2 {
+		var err error
+		if duration, err = time.ParseDuration(args[1]); err != nil || duration <= 0 || duration > model.MaxMuteDuration {
+			call.reject(model.ReasonInvalid, fmt.Sprintf("a duration like 30s, 10m or 2h, up to %v", model.MaxMuteDuration))
+			return true
+		}
+	}
+	until := time.Now().Add(duration)
+	return session.muteByName(call, args[0], &until)
+}
+
+// runUnmute - will let the muted member post again.
+func (session *Session) runUnmute(call *commandCall) bool {
+	args := strings.Fields(call.args)
+	if len(args) != 1 {
+		call.reject(model.ReasonInvalid, "usage: "+commands[call.name].usage)
+		return true
+	}
+	return session.muteByName(call, args[0], nil)
+}
+
+// muteByName - will mute the member with the username or the nickname until the time, or unmute if it's nil,
+// if the client's member may moderate that member.
+func (session *Session) muteByName(call *commandCall, username string, until *time.Time) bool {
+	username = strings.TrimPrefix(username, "@")
+	actor, err := session.db.ReadMember(session.GUID, call.client.UserID)
+	if err != nil {
+		log.Logger.Error(err)
+		call.reject(model.ReasonInternal, "")
+		return true
+	}
+	members, err := session.db.ReadChatMembers(session.GUID)
+	if err != nil {
+		log.Logger.Error(err)
+		call.reject(model.ReasonInternal, "")
+		return true
+	}
+	var target *model.Member
+	for i := range members {
+		if strings.EqualFold(members[i].Username, username) || strings.EqualFold(members[i].Nickname, username) {
+			target = &members[i]
+			break
+		}
+	}
+	if target == nil {
+		call.reject(model.ReasonInvalid, "no member named "+username)
+		return true
+	}
+
+	event, details := audit.EventMemberMuted, "member "+target.UserID
+	if until == nil {
+		event = audit.EventMemberUnmuted
+	} else {
+		details += " until " + until.UTC().Format(time.RFC3339)
+	}
+	if !model.CanModerate(actor.Role, target.Role) {
+		log.Logger.Warnf("Client [%s] isn't allowed to moderate [%s] in the chat with GUID %s", call.client, target.Client, session.GUID)
+		session.audit(event, audit.OutcomeDenied, call.client, details)
+		call.reject(model.ReasonForbidden, "only moderators can mute, and only members below them")
+		return true
+	}
+
+	if _, err := session.db.MuteMember(session.GUID, target.UserID, until); err != nil {
+		log.Logger.Error(err)
+		call.reject(model.ReasonInternal, "")
+		return true
+	}
+	session.audit(event, audit.OutcomeAllowed, call.client, details)
+	call.conn.ack(call.requestID, model.Message{})
+	session.Mute(target.Client, until, *call.client)
+	return true
+}
@@ -0,0 +1,110 @@
+package session
+
+import (
+	"github.com/gorilla/websocket"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/presence"
+	"testing"
+	"time"
+)
+
+// send - will send the text as the request ID and wait for its ack.
+func send(t *testing.T, conn *websocket.Conn, requestID, text string) model.Ack {
+	return sendMessage(t, conn, requestID, model.Message{Text: text})
+}
+
+// sendMessage - will send the message in a frame with the request ID and wait for the ack of it.
+func sendMessage(t *testing.T, conn *websocket.Conn, requestID string, msg model.Message) model.Ack {
+	if err := conn.WriteJSON(&model.Payload{RequestID: requestID, Messages: []model.Message{msg}}); err != nil {
+		t.Fatalf("Error when writing %v, want none", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		payload := model.Payload{}
+		if err := conn.ReadJSON(&payload); err != nil {
+			t.Fatalf("Error when reading %v, want the ack of %s", err, requestID)
+		}
+		if payload.Ack != nil && payload.Ack.RequestID == requestID {
+			return *payload.Ack
+		}
+	}
+}
+
+// TestModeration - muted and read-only members can't post, and only moderators mute members below them,
+// by their usernames or nicknames.
+func TestModeration(t *testing.T) {
+	store := &fakeStore{members: []model.Member{
+		{Client: model.Client{UserID: "1", Username: "user1"}, Role: model.RoleOwner},
+		{Client: model.Client{UserID: "2", Username: "user2"}, Role: model.RoleMember},
+		{Client: model.Client{UserID: "3", Username: "user3"}, Role: model.RoleReadOnly},
+	}, nicknames: map[string]string{"2": "Bob"}}
+	sess := New("test-guid", store, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	owner := dial(t, server, "1")
+	defer owner.Close()
+	member := dial(t, server, "2")
+	defer member.Close()
+	reader := dial(t, server, "3")
+	defer reader.Close()
+
+	steps := []struct {
+		conn   *websocket.Conn
+		text   string
+		reason string
+	}{
+		{reader, "hello", model.ReasonForbidden},
+		{member, "/mute @user1", model.ReasonForbidden},
+		{owner, "/mute user2 1h", ""},
+		{member, "hello", model.ReasonMuted},
+		{member, "/me waves", model.ReasonMuted},
+		{owner, "/mute nobody", model.ReasonInvalid},
+		{owner, "/unmute User2", ""},
+		{member, "hello", ""},
+		{owner, "/mute bob 1h", ""},
+		{member, "hello", model.ReasonMuted},
+		{owner, "/unmute @BOB", ""},
+		{member, "hello", ""},
+	}
+	for i, step := range steps {
+		ack := send(t, step.conn, string(rune('a'+i)), step.text)
+		if ack.OK != (step.reason == "") || ack.Reason != step.reason {
+			t.Errorf("Got ack %+v for %q, want reason %q", ack, step.text, step.reason)
+		}
+	}
+}
+
+// TestRemovedMemberDisconnected - a client still connected after its member was kicked or banned can't post,
+// and is disconnected.
+func TestRemovedMemberDisconnected(t *testing.T) {
+	store := &fakeStore{removed: map[string]bool{"2": true}}
+	sess := New("test-guid", store, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	conn := dial(t, server, "2")
+	defer conn.Close()
+
+	if ack := send(t, conn, "1", "hello"); ack.OK || ack.Reason != model.ReasonForbidden {
+		t.Errorf("Got ack %+v, want reason %q", ack, model.ReasonForbidden)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error when reading %v, want the connection closed as a policy violation", err)
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.msgs) != 0 {
+		t.Errorf("Saved %v messages, want none", len(store.msgs))
+	}
+}
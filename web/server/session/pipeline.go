@@ -0,0 +1,186 @@
+package session
+
+import (
+	"fmt"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+)
+
+// MessageContext - a message on its way through the pipeline, with the chat and the client who sent it.
+// Hooks rewrite the message in place, and annotate it through its annotations.
+type MessageContext struct {
+	ChatGUID string
+	Client   model.Client
+	Message  model.Message
+}
+
+// Annotate - will attach the annotation to the message. Annotations reach the clients with the message,
+// but aren't saved.
+func (ctx *MessageContext) Annotate(key, value string) {
+	if ctx.Message.Annotations == nil {
+		ctx.Message.Annotations = make(map[string]string)
+	}
+	ctx.Message.Annotations[key] = value
+}
+
+// PreValidator - a hook called with the message as the client sent it, before it's validated.
+type PreValidator interface {
+	PreValidate(ctx *MessageContext) error
+}
+
+// Transformer - a hook called with the validated message, before it's run as a command or posted.
+// The transformed message is validated again.
+type Transformer interface {
+	Transform(ctx *MessageContext) error
+}
+
+// PrePersister - a hook called with the stamped message right before it's saved.
+type PrePersister interface {
+	PrePersist(ctx *MessageContext) error
+}
+
+// PostPersister - a hook called with the saved message, which can't be rejected any longer.
+type PostPersister interface {
+	PostPersist(ctx *MessageContext)
+}
+
+// PreBroadcaster - a hook called with the saved message after the post-persist hooks, right before it's broadcast.
+// The message is delivered as the hook leaves it, but it's saved already, so it can't be rejected any longer:
+// messages that shouldn't reach the chat are rejected before they're saved.
+type PreBroadcaster interface {
+	PreBroadcast(ctx *MessageContext)
+}
+
+// Rejection - an error hooks reject a message with, telling the client the reason and the details.
+// Any other error rejects the message as an internal one.
+type Rejection struct {
+	Reason  string
+	Details string
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("%s - %s", r.Reason, r.Details)
+}
+
+// Reject - will return a Rejection for the reason, like model.ReasonForbidden, with the details.
+func Reject(reason, details string) error {
+	return &Rejection{Reason: reason, Details: details}
+}
+
+// Pipeline - the middleware messages pass through on their way from a client to the others.
+// A middleware implements any of the hook interfaces, and its hooks are called in the order it was added.
+// Middleware is added before the pipeline is handed to sessions. A nil Pipeline has no middleware.
+type Pipeline struct {
+	preValidators   []PreValidator
+	transformers    []Transformer
+	prePersisters   []PrePersister
+	postPersisters  []PostPersister
+	preBroadcasters []PreBroadcaster
+}
+
+// NewPipeline - will construct and return a Pipeline with the middleware.
+func NewPipeline(middleware ...interface{}) *Pipeline {
+	p := &Pipeline{}
+	for _, m := range middleware {
+		p.Use(m)
+	}
+	return p
+}
+
+// Use - will add the middleware to the pipeline. Panics if it implements none of the hooks.
+func (p *Pipeline) Use(middleware interface{}) {
+	used := false
+	if hook, ok := middleware.(PreValidator); ok {
+		p.preValidators = append(p.preValidators, hook)
+		used = true
+	}
+	if hook, ok := middleware.(Transformer); ok {
+		p.transformers = append(p.transformers, hook)
+		used = true
+	}
+	if hook, ok := middleware.(PrePersister); ok {
+		p.prePersisters = append(p.prePersisters, hook)
+		used = true
+	}
+	if hook, ok := middleware.(PostPersister); ok {
+		p.postPersisters = append(p.postPersisters, hook)
+		used = true
+	}
+	if hook, ok := middleware.(PreBroadcaster); ok {
+		p.preBroadcasters = append(p.preBroadcasters, hook)
+		used = true
+	}
+	if !used {
+		panic(fmt.Sprintf("session: middleware %T implements no pipeline hook", middleware))
+	}
+}
+
+// preValidate - will run the pre-validate hooks, stopping at the first rejection.
+func (p *Pipeline) preValidate(ctx *MessageContext) error {
+	if p == nil {
+		return nil
+	}
+	for _, hook := range p.preValidators {
+		if err := hook.PreValidate(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transform - will run the transform hooks, stopping at the first rejection.
+func (p *Pipeline) transform(ctx *MessageContext) error {
+	if p == nil {
+		return nil
+	}
+	for _, hook := range p.transformers {
+		if err := hook.Transform(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prePersist - will run the pre-persist hooks, stopping at the first rejection.
+func (p *Pipeline) prePersist(ctx *MessageContext) error {
+	if p == nil {
+		return nil
+	}
+	for _, hook := range p.prePersisters {
+		if err := hook.PrePersist(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postPersist - will run the post-persist hooks.
+func (p *Pipeline) postPersist(ctx *MessageContext) {
+	if p == nil {
+		return
+	}
+	for _, hook := range p.postPersisters {
+		hook.PostPersist(ctx)
+	}
+}
+
+// preBroadcast - will run the pre-broadcast hooks.
+func (p *Pipeline) preBroadcast(ctx *MessageContext) {
+	if p == nil {
+		return
+	}
+	for _, hook := range p.preBroadcasters {
+		hook.PreBroadcast(ctx)
+	}
+}
+
+// rejectWith - will tell the client why the pipeline rejected its message.
+func (c *connection) rejectWith(requestID string, err error) {
+	if rejection, ok := err.(*Rejection); ok {
+		log.Logger.Warnf("Pipeline rejected a message from client [%s] - %s", c.client, rejection)
+		c.nack(requestID, rejection.Reason, rejection.Details)
+		return
+	}
+	log.Logger.Errorf("Pipeline failed on a message from client [%s] - %s", c.client, err)
+	c.nack(requestID, model.ReasonInternal, "")
+}
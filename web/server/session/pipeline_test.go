@@ -0,0 +1,155 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/presence"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// censor - rejects spam before validation and blanks out a word after it.
+type censor struct{}
+
+func (censor) PreValidate(ctx *MessageContext) error {
+	if strings.Contains(ctx.Message.Text, "spam") {
+		return Reject(model.ReasonForbidden, "no spam")
+	}
+	return nil
+}
+
+func (censor) Transform(ctx *MessageContext) error {
+	ctx.Message.Text = strings.ReplaceAll(ctx.Message.Text, "darn", "")
+	return nil
+}
+
+// tagger - keeps quiet messages from the chat and annotates the plain ones before they're saved, records messages
+// once saved and annotates them again right before they're broadcast.
+type tagger struct {
+	mu    sync.Mutex
+	saved []int64
+}
+
+func (tg *tagger) PrePersist(ctx *MessageContext) error {
+	switch ctx.Message.Text {
+	case "broken":
+		return errors.New("not a rejection")
+	case "quiet":
+		return Reject(model.ReasonForbidden, "")
+	}
+	if ctx.Message.Kind == "" {
+		ctx.Annotate("sender", ctx.Client.UserID)
+	}
+	return nil
+}
+
+func (tg *tagger) PostPersist(ctx *MessageContext) {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	tg.saved = append(tg.saved, ctx.Message.ID)
+	ctx.Annotate("saved", fmt.Sprint(ctx.Message.ID))
+}
+
+func (tg *tagger) PreBroadcast(ctx *MessageContext) {
+	ctx.Annotate("seq", fmt.Sprint(ctx.Message.Seq))
+}
+
+// TestPipeline - middleware rejects, rewrites and annotates messages at each stage of the send path.
+func TestPipeline(t *testing.T) {
+	tg := &tagger{}
+	sess := New("test-guid", &fakeStore{}, nil, presence.NewTracker(nil), nil, nil, NewPipeline(censor{}, tg))
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	observer := dial(t, server, "observer")
+	defer observer.Close()
+	sender := dial(t, server, "1")
+	defer sender.Close()
+
+	steps := []struct {
+		text   string
+		reason string
+		want   string
+	}{
+		{"buy spam", model.ReasonForbidden, ""},
+		{"darn", model.ReasonEmpty, ""},
+		{"broken", model.ReasonInternal, ""},
+		{"darn  good", "", "good"},
+		{"quiet", model.ReasonForbidden, ""},
+		{"/me darn waves", "", "waves"},
+	}
+	for i, step := range steps {
+		ack := send(t, sender, string(rune('a'+i)), step.text)
+		if ack.OK != (step.reason == "") || ack.Reason != step.reason {
+			t.Errorf("Got ack %+v for %q, want reason %q", ack, step.text, step.reason)
+		}
+		if step.want == "" {
+			continue
+		}
+		// A message kept from the chat would arrive first. Actions get no annotations before they're saved.
+		got := nextMessage(t, observer)
+		wantSender := "1"
+		if got.Kind == model.MessageKindAction {
+			wantSender = ""
+		}
+		if got.Text != step.want || got.Annotations["sender"] != wantSender {
+			t.Errorf("Got %+v for %q, want text %q annotated with the sender %q", got, step.text, step.want, wantSender)
+		}
+		if got.Annotations["saved"] != fmt.Sprint(ack.ID) || got.Annotations["seq"] != fmt.Sprint(ack.Seq) {
+			t.Errorf("Got annotations %v for %q, want the ID and the seq annotated after the save", got.Annotations, step.text)
+		}
+	}
+
+	tg.mu.Lock()
+	if len(tg.saved) != 2 {
+		t.Errorf("Post-persist hooks called for %v, want the 2 saved messages", tg.saved)
+	}
+	tg.mu.Unlock()
+
+	// A message kept from the chat is never read back, neither with the history, by a range nor on resume.
+	reader := dialQuery(t, server, "user=reader&pageSize=10")
+	defer reader.Close()
+	history := model.Payload{}
+	if err := reader.ReadJSON(&history); err != nil {
+		t.Fatalf("Error when reading %v, want none", err)
+	}
+	ranged := request(t, reader, &model.Payload{RequestID: "range", SeqFrom: 1, SeqTo: 10})
+	resumer := dialQuery(t, server, "user=resumer&lastSeq=1")
+	defer resumer.Close()
+	resumed := model.Payload{}
+	if err := resumer.ReadJSON(&resumed); err != nil {
+		t.Fatalf("Error when reading %v, want none", err)
+	}
+
+	reads := []struct {
+		name    string
+		payload model.Payload
+		want    []string
+	}{
+		{"history", history, []string{"waves", "good"}},
+		{"range", ranged, []string{"waves", "good"}},
+		{"resume", resumed, []string{"waves"}},
+	}
+	for _, read := range reads {
+		texts := make([]string, 0)
+		for _, msg := range read.payload.Messages {
+			texts = append(texts, msg.Text)
+		}
+		if strings.Join(texts, ",") != strings.Join(read.want, ",") {
+			t.Errorf("Read %q with the %s, want %q", texts, read.name, read.want)
+		}
+	}
+}
+
+// TestPipelineUse - middleware implementing no hook is refused.
+func TestPipelineUse(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("No panic on middleware without hooks, want one")
+		}
+	}()
+	NewPipeline(struct{}{})
+}
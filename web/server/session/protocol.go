@@ -0,0 +1,59 @@
+package session
+
+import (
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"sort"
+)
+
+// protocol - a version of the typed protocol with the encoding of its frames.
+type protocol struct {
+	version int
+	codec   codec
+}
+
+// protocols - the protocols by the names clients negotiate them with in Sec-WebSocket-Protocol.
+// A client that negotiates none speaks the untyped protocol: it exchanges bare JSON payloads, typed by untypedFrameType.
+var protocols = map[string]protocol{
+	"chat.v1":         {version: 1, codec: jsonCodec{}},
+	"chat.v1.msgpack": {version: 1, codec: msgpackCodec{}},
+}
+
+// latestVersion - the latest version of the typed protocol, spoken by the clients of the HTTP transports.
+const latestVersion = 1
+
+// untypedProtocol - the protocol of the clients that negotiated none.
+var untypedProtocol = protocol{version: 0, codec: jsonCodec{}}
+
+// negotiated - will return the protocol of the given name, or the untyped protocol if there's none.
+func negotiated(name string) protocol {
+	if p, ok := protocols[name]; ok {
+		return p
+	}
+	return untypedProtocol
+}
+
+// subprotocols - will list the names of the protocols, for the upgrader.
+func subprotocols() []string {
+	names := make([]string, 0, len(protocols))
+	for name := range protocols {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// untypedFrameType - will tell the type of a frame of the untyped protocol from which of its fields are set.
+func untypedFrameType(payload *model.Payload) string {
+	switch {
+	case payload.Notification != nil:
+		return model.TypePresence
+	case payload.Typing != nil:
+		return model.TypeTyping
+	case payload.PageToken != "":
+		return model.TypeHistory
+	case payload.SeqFrom > 0:
+		return model.TypeRange
+	default:
+		return model.TypeMessage
+	}
+}
@@ -3,201 +3,422 @@
 package session
 
 import (
+	"fmt"
 	"github.com/gorilla/websocket"
 	log "gitlab.starlink.ua/high-school-prod/chat/logger"
-	"gitlab.starlink.ua/high-school-prod/chat/server/database"
+	"gitlab.starlink.ua/high-school-prod/chat/server/audit"
+	"gitlab.starlink.ua/high-school-prod/chat/server/config"
+	"gitlab.starlink.ua/high-school-prod/chat/server/mentions"
 	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/presence"
+	"gitlab.starlink.ua/high-school-prod/chat/server/ratelimit"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
+// Store - the persistence a session relies on, implemented by the database package.
+type Store interface {
+	ReadRecentMessages(guid string, numMsgs int, pageToken string) model.Payload
+	ReadMessageRange(guid string, fromSeq, toSeq int64, numMsgs int) (model.Payload, error)
+	SaveMessage(msg model.Message) (model.Message, bool, error)
+	ReadChatMembers(guid string) ([]model.Member, error)
+	ReadMember(guid, userID string) (model.Member, error)
+	MuteMember(guid, userID string, until *time.Time) (bool, error)
+	SaveMentions(msg model.Message, users []model.Client) ([]model.Mention, error)
+	ReadChat(guid string) (model.Chat, error)
+	SetChatTopic(guid, topic string) error
+	ReadNickname(guid, userID string) (string, error)
+	SetNickname(guid, userID, nickname string) error
+}
+
 // Session - handles a single chat session for a set of clients.
+// The clients map is shared by the connection goroutines and the broadcaster, so it's guarded by mu.
+// Every goroutine the session starts is tracked by wg, so that Close can wait for all of them to exit.
 type Session struct {
-	GUID      string
-	db        *database.Database
-	clients   map[*websocket.Conn]*model.Client
-	broadcast chan model.Message
+	GUID        string
+	db          Store
+	auditor     *audit.Auditor
+	presence    *presence.Tracker
+	limiter     *ratelimit.Limiter
+	mentions    *mentions.Hub
+	pipeline    *Pipeline
+	limit       *ratelimit.Bucket
+	unsubscribe func()
+	mu          sync.RWMutex
+	clients     map[*connection]*model.Client
+	closed      bool
+	typingMu    sync.Mutex
+	typing      map[string]*typingState
+	nickMu      sync.Mutex
+	nicknames   map[string]string
+	broadcast   chan model.Message
+	done        chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
 }
 
 // New will construct and return a new session.
-func New(GUID string, dbP *database.Database) *Session {
+func New(GUID string, dbP Store, auditor *audit.Auditor, tracker *presence.Tracker, limiter *ratelimit.Limiter, hub *mentions.Hub,
+	pipeline *Pipeline) *Session {
 	session := &Session{
 		GUID:      GUID,
 		db:        dbP,
-		clients:   make(map[*websocket.Conn]*model.Client),
+		auditor:   auditor,
+		presence:  tracker,
+		limiter:   limiter,
+		mentions:  hub,
+		pipeline:  pipeline,
+		limit:     ratelimit.NewChatBucket(),
+		clients:   make(map[*connection]*model.Client),
+		typing:    make(map[string]*typingState),
+		nicknames: make(map[string]string),
 		broadcast: make(chan model.Message),
+		done:      make(chan struct{}),
 	}
 
 	log.Logger.Infof("Opened a new chat session with id %v", session.GUID)
 
+	// Relay transitions of presence in this chat to the clients.
+	session.unsubscribe = tracker.Subscribe(GUID, session.sendPresence)
+
+	session.wg.Add(1)
 	go session.handleMessages() // Listens to the incoming messages.
 
 	return session
 }
 
 // A go routine that monitors broadcast channel and populates clients' feed.
+// Payloads are only queued here, so a slow or dead client can't stall the others.
 func (session *Session) handleMessages() {
+	defer session.wg.Done()
 	for {
-		msg := <-session.broadcast
+		var msg model.Message
+		select {
+		case <-session.done:
+			return
+		case msg = <-session.broadcast:
+		}
 		log.Logger.Infof("Transmitting to all clients: %s", msg)
-		for client := range session.clients {
-			msgs := make([]model.Message, 0)
-			msgs = append(msgs, msg)
-			payload := model.Payload{
-				Messages:  msgs,
-				PageToken: "",
-			}
-			err := client.WriteJSON(&payload)
-			if err != nil {
-				log.Logger.Error(err)
-				return
-			}
+		payload := &model.Payload{
+			Messages: []model.Message{msg},
+		}
+		session.mu.RLock()
+		for c := range session.clients {
+			c.enqueueLive(model.TypeMessage, payload, msg.Seq)
 		}
+		session.mu.RUnlock()
+	}
+}
+
+// pageSize - will bound the page size requested by a client by MAX_PAGE_SIZE.
+// Falls back to DEFAULT_PAGE_SIZE if the client didn't request any.
+func pageSize(requested int) int {
+	maxPageSize := config.Int("MAX_PAGE_SIZE", 100)
+	if requested <= 0 {
+		requested = config.Int("DEFAULT_PAGE_SIZE", 25)
+	}
+	if requested > maxPageSize {
+		return maxPageSize
 	}
+	return requested
 }
 
 // Declaring an upgrader in order to establish the WebSocket connection.
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: subprotocols(),
 }
 
-// UpgradeAndHandle upgrades an incoming request to a WebSocket and handles messages.
-// Returns true if session needs to be deleted, otherwise - false.
-func (session *Session) UpgradeAndHandle(w http.ResponseWriter, r *http.Request, client *model.Client) (deleteSession bool) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// Close - will stop the session's broadcaster and close all of its connections,
+// waiting for the goroutines of the session to exit. Closing a closed session does nothing.
+func (session *Session) Close() {
+	session.closeWith(websocket.CloseNormalClosure, "")
+}
+
+// GoAway - will close the session like Close, telling the clients that the server is going away
+// and they should reconnect.
+func (session *Session) GoAway() {
+	session.closeWith(websocket.CloseGoingAway, "server going away, reconnect")
+}
+
+// closeWith - will close the session, closing its connections with the given close frame once their queues are sent.
+func (session *Session) closeWith(code int, text string) {
+	session.closeOnce.Do(func() {
+		session.mu.Lock()
+		session.closed = true
+		for conn := range session.clients {
+			conn.closeWith(code, text)
+		}
+		session.mu.Unlock()
+
+		close(session.done)
+		session.unsubscribe()
+		session.stopTyping()
+		session.wg.Wait()
+		log.Logger.Infof("Closed the chat session with id %v", session.GUID)
+	})
+}
+
+// UpgradeAndHandle upgrades an incoming request to a WebSocket and handles messages until the client leaves.
+func (session *Session) UpgradeAndHandle(w http.ResponseWriter, r *http.Request, client *model.Client) {
+	wsConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Logger.Error(err)
+		session.audit(audit.EventUpgradeFailed, audit.OutcomeDenied, client, err.Error())
+		return
 	}
 
-	session.clients[conn] = client
+	conn := newConnection(wsConn, client)
+	if !session.join(conn, r) {
+		return
+	}
+	defer session.leave(conn)
+
+	for {
+		envelope := model.Envelope{}
+		err := conn.read(&envelope)
+		if malformed, ok := err.(*malformedError); ok {
+			log.Logger.Errorf("Client [%s] sent a %s", client, malformed)
+			conn.nack("", model.ReasonInvalid, "malformed frame")
+			continue
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			log.Logger.Infof("Client [%s] stopped responding, reaping the connection", client)
+			return
+		}
+		if err != nil {
+			log.Logger.Error(err)
+			return
+		}
+
+		// Dispatching the frame to the handler of its type.
+		handle, ok := handlers[envelope.Type]
+		if !ok {
+			log.Logger.Errorf("Client [%s] sent a frame of unknown type [%s]", client, envelope.Type)
+			conn.nack(envelope.RequestID, model.ReasonInvalid, fmt.Sprintf("unknown frame type [%s]", envelope.Type))
+			continue
+		}
+		if !handle(session, conn, &envelope.Payload) {
+			return
+		}
+	}
+}
+
+// join - will add the connection to the session, announce the client and send it the missed or the recent messages
+// before switching to live delivery. Returns false if the client couldn't join, with the connection closed.
+func (session *Session) join(conn *connection, r *http.Request) bool {
+	client := conn.client
+	if !session.addClient(conn) {
+		log.Logger.Warnf("Session with GUID %s is closed, dropping client with id %s.", session.GUID, client.UserID)
+		conn.close()
+		return false
+	}
 	log.Logger.Infof("Adding client with id %s to the session with GUID %s.", client.UserID, session.GUID)
+	session.audit(audit.EventJoin, audit.OutcomeAllowed, client, "")
 
-	// Notify other clients that user has gone online.
-	session.sendOnlineNotification(*client, true)
+	// Notify other clients that user has gone online, unless they already see the user online on another device.
+	session.presence.Connect(session.GUID, *client, conn)
 
 	// Notify this user about other clients' statuses.
 	session.sendStatuses(conn)
 
-	defer func() {
-		err := conn.Close()
-		if err != nil {
-			log.Logger.Error(err)
-		}
+	payload := session.initialPayload(r)
+	log.Logger.Infof("Sending \n%s", payload.Messages)
+	if err := conn.writeInitial(&payload); err != nil {
+		log.Logger.Error(err)
+		session.leave(conn)
+		return false
+	}
+	conn.open()
 
-		log.Logger.Infof("Deleting client with id %s from the session with GUID %s.", client.UserID, session.GUID)
-		deleteSession = session.deleteClient(conn)
+	// Deliver the mentions of the user in any chat while the client is connected to this one.
+	conn.unsubscribe = session.mentions.Subscribe(client.UserID, func(mention model.Mention) {
+		conn.enqueue(model.TypeMention, &model.Payload{Mention: &mention})
+	})
+	return true
+}
 
-		// Notify other clients that user has gone offline.
-		session.sendOnlineNotification(*client, false)
+// leave - will close the connection and remove it from the session, announcing that the client left.
+func (session *Session) leave(conn *connection) {
+	client := conn.client
+	conn.close()
 
-		return
-	}()
+	log.Logger.Infof("Deleting client with id %s from the session with GUID %s.", client.UserID, session.GUID)
+	session.deleteClient(conn)
+	if conn.unsubscribe != nil {
+		conn.unsubscribe()
+	}
+	session.audit(audit.EventLeave, audit.OutcomeAllowed, client, "")
+	session.setTyping(*client, false)
 
-	// Send the recent messages to the new client.
-	payload := session.db.ReadRecentMessages(session.GUID, 25, "")
-	log.Logger.Infof("Sending \n%s", payload.Messages)
-	err = conn.WriteJSON(&payload)
+	// Notify other clients that user has gone offline, unless the user is still online on another device.
+	session.presence.Disconnect(session.GUID, client.UserID, conn)
+}
+
+// initialPayload - will read what a joining client gets first: the metadata of the chat and the messages.
+func (session *Session) initialPayload(r *http.Request) model.Payload {
+	payload := session.initialMessages(r)
+	chat, err := session.db.ReadChat(session.GUID)
 	if err != nil {
 		log.Logger.Error(err)
-		return
+		return payload
 	}
+	payload.Chat = &chat
+	return payload
+}
 
-	for {
-		// Reading the received payload as a JSON.
-		payload := model.Payload{}
-		err := conn.ReadJSON(&payload)
+// initialMessages - will read the messages a joining client gets first. A client resuming after a reconnect presents
+// the sequence number of the last message it saw as lastSeq, or as Last-Event-ID if it's an EventSource,
+// and gets every message since then.
+// A client that missed more than RESUME_MAX_MESSAGES is told to resync instead, and gets the recent messages,
+// as many as it asked for with pageSize, like a new client.
+func (session *Session) initialMessages(r *http.Request) model.Payload {
+	query := r.URL.Query()
+	requestedPageSize, _ := strconv.Atoi(query.Get("pageSize"))
+	lastSeq := requestedLastSeq(r)
+
+	if lastSeq > 0 {
+		payload, err := session.db.ReadMessageRange(session.GUID, lastSeq+1, math.MaxInt64, config.Int("RESUME_MAX_MESSAGES", 500))
 		if err != nil {
 			log.Logger.Error(err)
-			return
-		}
-
-		// If payload has a page token, respond with the corresponding messages, and do not broadcast.
-		if payload.PageToken != "" {
-			log.Logger.Infof("Received page token %s", payload.PageToken)
-			payload := session.db.ReadRecentMessages(session.GUID, 25, payload.PageToken)
-			err := conn.WriteJSON(&payload)
-			if err != nil {
-				log.Logger.Error(err)
-				return
+		} else if !payload.HasMore {
+			log.Logger.Infof("Resuming client after message %v, %v missed", lastSeq, len(payload.Messages))
+			payload.SeqTo = lastSeq
+			if len(payload.Messages) > 0 {
+				payload.SeqTo = payload.Messages[0].Seq
 			}
-			continue
+			return payload
 		}
+		log.Logger.Infof("Client can't resume after message %v, telling it to resync", lastSeq)
+	}
 
-		receivedMsg := payload.Messages[0]
+	payload := session.db.ReadRecentMessages(session.GUID, pageSize(requestedPageSize), "")
+	payload.Resync = lastSeq > 0
+	return payload
+}
 
-		// If message length is more than 8K chars - do not broadcast and do not save to the DB.
-		if len(receivedMsg.Text) > 8000 {
-			log.Logger.Errorf("Message too long - length [%v], from client [%s]", len(receivedMsg.Text), client)
-			continue
-		}
+// punish - will mute or disconnect a client that keeps flooding the chat.
+func (session *Session) punish(conn *connection, verdict ratelimit.Verdict) {
+	switch verdict {
+	case ratelimit.Mute:
+		log.Logger.Warnf("Client [%s] keeps flooding the chat with GUID %s, muting", conn.client, session.GUID)
+		session.audit(audit.EventFlooding, audit.OutcomeDenied, conn.client, "muted")
+	case ratelimit.Disconnect:
+		log.Logger.Warnf("Client [%s] keeps flooding the chat with GUID %s, disconnecting", conn.client, session.GUID)
+		session.audit(audit.EventFlooding, audit.OutcomeDenied, conn.client, "disconnected")
+		conn.closeWith(websocket.ClosePolicyViolation, "flooding")
+	default:
+		log.Logger.Infof("Client [%s] is over the rate limit", conn.client)
+	}
+}
 
-		timestamp := time.Now().UTC().Format("01-02-2006 15:04:05.000000 UTC")
-		receivedMsg.Timestamp = timestamp
-		receivedMsg.ChatGUID = session.GUID
-		receivedMsg.UserID = session.clients[conn].UserID
-		receivedMsg.Username = session.clients[conn].Username
+// requestedLastSeq - will return the sequence number of the last message the client saw, if it told any.
+func requestedLastSeq(r *http.Request) int64 {
+	lastSeq := r.URL.Query().Get("lastSeq")
+	if lastSeq == "" {
+		lastSeq = r.Header.Get("Last-Event-ID")
+	}
+	parsed, _ := strconv.ParseInt(lastSeq, 10, 64)
+	return parsed
+}
 
-		log.Logger.Infof("Message received: %s", receivedMsg)
+// addClient adds a client to session clients and starts its writer.
+// Returns false if the session is already closed.
+func (session *Session) addClient(conn *connection) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
 
-		session.db.MsgChan <- receivedMsg
-		session.broadcast <- receivedMsg
+	if session.closed {
+		return false
 	}
+	session.clients[conn] = conn.client
+	conn.start(&session.wg)
+	return true
 }
 
 // deleteClient deletes a client from session clients.
-// Returns true if the session needs to be deleted, otherwise - false.
-func (session *Session) deleteClient(conn *websocket.Conn) (deleteSession bool) {
+func (session *Session) deleteClient(conn *connection) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
 	delete(session.clients, conn)
+}
 
-	// If this client was the last one in the session - delete the session.
-	if len(session.clients) == 0 {
-		deleteSession = true
-	} else {
-		deleteSession = false
+// sendPresence will send a notification to all clients when a user goes online, away or offline.
+func (session *Session) sendPresence(notification model.Notification) {
+	log.Logger.Infof("Sending notification to all clients: [%s] is %s", notification.Client, notification.State)
+	payload := &model.Payload{
+		Notification: &notification,
+	}
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	for conn, client := range session.clients {
+		// Avoid sending notifications to ourselves.
+		if client.UserID != notification.Client.UserID {
+			conn.enqueue(model.TypePresence, payload)
+		}
 	}
-	return deleteSession
 }
 
-// sendOnlineNotification will send a notification to all clients when user goes joins or leaves the session.
-func (session *Session) sendOnlineNotification(user model.Client, isOnline bool) {
-	log.Logger.Infof("Sending notification to all clients: [%s] is online [%v]", user, isOnline)
-	for conn := range session.clients {
-		payload := model.Payload{
-			Notification: &model.Notification{
-				Client:   &user,
-				IsOnline: isOnline,
-			},
-		}
+// sendStatuses will send the statuses of all users present in the chat to the user when he joins the session.
+func (session *Session) sendStatuses(conn *connection) {
+	log.Logger.Infof("Sending all statuses to client [%s]", conn.client)
+	for _, notification := range session.presence.Snapshot(session.GUID) {
+		notification := notification
 
 		// Avoid sending notifications to ourselves.
-		if session.clients[conn].UserID != user.UserID {
-			err := conn.WriteJSON(&payload)
-			if err != nil {
-				log.Logger.Error(err)
-				return
-			}
+		if notification.Client.UserID != conn.client.UserID {
+			conn.enqueue(model.TypePresence, &model.Payload{Notification: &notification})
 		}
 	}
 }
 
-// sendStatuses will send all clients' statuses to the user when he joins the session.
-func (session *Session) sendStatuses(conn *websocket.Conn) {
-	log.Logger.Infof("Sending all statuses to client [%s]", session.clients[conn])
-	for _, client := range session.clients {
-		payload := model.Payload{
-			Notification: &model.Notification{
-				Client:   client,
-				IsOnline: true,
-			},
-		}
+// audit - will record a security-relevant event concerning the client in this session.
+func (session *Session) audit(event, outcome string, client *model.Client, details string) {
+	session.auditor.Record(model.AuditRecord{
+		Event:    event,
+		ActorID:  client.UserID,
+		ChatGUID: session.GUID,
+		IP:       client.IP,
+		Outcome:  outcome,
+		Details:  details,
+	})
+}
 
-		// Avoid sending notifications to ourselves.
-		if client.UserID != session.clients[conn].UserID {
-			err := conn.WriteJSON(&payload)
-			if err != nil {
-				log.Logger.Error(err)
-				return
-			}
+// AddMember - will notify all clients that the user was added to the chat.
+func (session *Session) AddMember(member model.Client) {
+	session.sendMembershipNotification(member, true)
+}
+
+// RemoveMember - will notify all clients that the user was removed from the chat and close the user's connections.
+func (session *Session) RemoveMember(member model.Client) {
+	session.sendMembershipNotification(member, false)
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	for conn, client := range session.clients {
+		if client.UserID == member.UserID {
+			log.Logger.Infof("Closing connection of removed member [%s] in the session with GUID %s.", client, session.GUID)
+			conn.closeAfterFlush()
 		}
 	}
 }
+
+// sendMembershipNotification will send a notification to all clients when a user is added to or removed from the chat.
+func (session *Session) sendMembershipNotification(member model.Client, isMember bool) {
+	log.Logger.Infof("Sending notification to all clients: [%s] is member [%v]", member, isMember)
+	payload := &model.Payload{
+		Membership: &model.MembershipNotification{
+			Client:   &member,
+			IsMember: isMember,
+		},
+	}
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	for conn := range session.clients {
+		conn.enqueue(model.TypeMembership, payload)
+	}
+}
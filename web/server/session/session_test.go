@@ -0,0 +1,897 @@
+package session
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/database"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/presence"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.Logger.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeStore - an in-memory Store.
+type fakeStore struct {
+	mu        sync.Mutex
+	msgs      []model.Message
+	members   []model.Member
+	mentions  []model.Mention
+	chat      model.Chat
+	nicknames map[string]string
+	// removed - users who were members once, but were kicked or banned since.
+	removed map[string]bool
+}
+
+// ReadRecentMessages - will page through the messages newest first. The page token is the ID of the oldest message
+// of the previous page.
+func (s *fakeStore) ReadRecentMessages(guid string, numMsgs int, pageToken string) model.Payload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := int64(math.MaxInt64)
+	if pageToken != "" {
+		before, _ = strconv.ParseInt(pageToken, 10, 64)
+	}
+	payload := model.Payload{Messages: make([]model.Message, 0), PageSize: numMsgs}
+	for i := len(s.msgs) - 1; i >= 0; i-- {
+		if s.msgs[i].ID >= before {
+			continue
+		}
+		if len(payload.Messages) == numMsgs {
+			payload.HasMore = true
+			break
+		}
+		payload.Messages = append(payload.Messages, s.msgs[i])
+		payload.PageToken = strconv.FormatInt(s.msgs[i].ID, 10)
+	}
+	return payload
+}
+
+func (s *fakeStore) ReadMessageRange(guid string, fromSeq, toSeq int64, numMsgs int) (model.Payload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payload := model.Payload{Messages: make([]model.Message, 0)}
+	for i := len(s.msgs) - 1; i >= 0; i-- {
+		if s.msgs[i].Seq >= fromSeq && s.msgs[i].Seq <= toSeq {
+			payload.Messages = append(payload.Messages, s.msgs[i])
+		}
+	}
+	if len(payload.Messages) > numMsgs {
+		payload.Messages = payload.Messages[len(payload.Messages)-numMsgs:]
+		payload.HasMore = true
+	}
+	return payload, nil
+}
+
+// SaveMessage - will save the message, unless the user already saved one with the same client message ID in the chat,
+// which is returned as a duplicate instead.
+func (s *fakeStore) SaveMessage(msg model.Message) (model.Message, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.ClientMsgID != "" {
+		for _, saved := range s.msgs {
+			if saved.ChatGUID == msg.ChatGUID && saved.UserID == msg.UserID && saved.ClientMsgID == msg.ClientMsgID {
+				return saved, true, nil
+			}
+		}
+	}
+	msg.Seq = int64(len(s.msgs) + 1)
+	msg.ID = msg.Seq
+	s.msgs = append(s.msgs, msg)
+	return msg, false, nil
+}
+
+func (s *fakeStore) ReadChatMembers(guid string) ([]model.Member, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := append([]model.Member(nil), s.members...)
+	for i := range members {
+		members[i].Nickname = s.nicknames[members[i].UserID]
+	}
+	return members, nil
+}
+
+// ReadMember - will return the member with the user ID, users who aren't listed are plain members.
+func (s *fakeStore) ReadMember(guid, userID string) (model.Member, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.removed[userID] {
+		return model.Member{}, database.ErrNotFound
+	}
+	for _, member := range s.members {
+		if member.UserID == userID {
+			return member, nil
+		}
+	}
+	return model.Member{Client: model.Client{UserID: userID, Username: "user" + userID}, Role: model.RoleMember}, nil
+}
+
+func (s *fakeStore) MuteMember(guid, userID string, until *time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.members {
+		if s.members[i].UserID == userID {
+			s.members[i].MutedUntil = until
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *fakeStore) SaveMentions(msg model.Message, users []model.Client) ([]model.Mention, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mentions := make([]model.Mention, 0, len(users))
+	for _, user := range users {
+		mention := model.Mention{ID: int64(len(s.mentions) + 1), UserID: user.UserID, Message: msg}
+		s.mentions = append(s.mentions, mention)
+		mentions = append(mentions, mention)
+	}
+	return mentions, nil
+}
+
+func (s *fakeStore) ReadChat(guid string) (model.Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chat, nil
+}
+
+func (s *fakeStore) SetChatTopic(guid, topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chat.Topic = topic
+	return nil
+}
+
+func (s *fakeStore) ReadNickname(guid, userID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nicknames[userID], nil
+}
+
+func (s *fakeStore) SetNickname(guid, userID, nickname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nicknames == nil {
+		s.nicknames = make(map[string]string)
+	}
+	s.nicknames[userID] = nickname
+	return nil
+}
+
+// newTestServer - will start a server attaching every WebSocket to the session, identified by the "user" query parameter.
+func newTestServer(sess *Session) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.URL.Query().Get("user")
+		sess.UpgradeAndHandle(w, r, &model.Client{UserID: user, Username: "user" + user})
+	}))
+}
+
+// dial - will open a WebSocket to the test server as the given user.
+func dial(t *testing.T, server *httptest.Server, user string) *websocket.Conn {
+	return dialQuery(t, server, "user="+user)
+}
+
+// dialQuery - will open a WebSocket to the test server with the given query.
+func dialQuery(t *testing.T, server *httptest.Server, query string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?" + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Error when dialing %v, want none", err)
+	}
+	return conn
+}
+
+// TestConcurrentJoinLeaveBroadcast - clients join, send and leave concurrently while an observer receives everything.
+// Meant to be run with -race.
+func TestConcurrentJoinLeaveBroadcast(t *testing.T) {
+	os.Setenv("SEND_QUEUE_SIZE", "1024")
+	defer os.Unsetenv("SEND_QUEUE_SIZE")
+	os.Setenv("RATE_LIMIT_CONNECTION", "0")
+	defer os.Unsetenv("RATE_LIMIT_CONNECTION")
+	os.Setenv("RATE_LIMIT_CHAT", "0")
+	defer os.Unsetenv("RATE_LIMIT_CHAT")
+
+	const (
+		numClients  = 20
+		numMessages = 10
+	)
+
+	store := &fakeStore{}
+	sess := New("test-guid", store, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+
+	// The observer stays connected for the whole test and counts the broadcast messages.
+	observer := dial(t, server, "observer")
+	defer observer.Close()
+	received := make(chan int64, numClients*numMessages)
+	go func() {
+		for {
+			payload := model.Payload{}
+			if err := observer.ReadJSON(&payload); err != nil {
+				return
+			}
+			for _, msg := range payload.Messages {
+				received <- msg.Seq
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Clients join concurrently, so they can't dial with dial, which stops the test on failure.
+			url := "ws" + strings.TrimPrefix(server.URL, "http") + "?user=" + fmt.Sprint(i)
+			conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+			if err != nil {
+				t.Errorf("Error when dialing %v, want none", err)
+				return
+			}
+			defer conn.Close()
+
+			// Drain whatever the client receives until it leaves.
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for {
+					if _, _, err := conn.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}()
+			defer func() {
+				message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				_ = conn.WriteMessage(websocket.CloseMessage, message)
+				<-done
+			}()
+
+			for j := 0; j < numMessages; j++ {
+				payload := model.Payload{Messages: []model.Message{{Text: fmt.Sprintf("%v-%v", i, j)}}}
+				if err := conn.WriteJSON(&payload); err != nil {
+					t.Errorf("Error when writing %v, want none", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int64]bool)
+	timeout := time.After(5 * time.Second)
+	for len(seen) < numClients*numMessages {
+		select {
+		case seq := <-received:
+			seen[seq] = true
+		case <-timeout:
+			t.Fatalf("Observer received %v messages, want %v", len(seen), numClients*numMessages)
+		}
+	}
+}
+
+// waitForGoroutines - will wait until no more than want goroutines are running.
+func waitForGoroutines(t *testing.T, want int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v goroutines running, want at most %v", runtime.NumGoroutine(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestCloseStopsGoroutines - closing a session disconnects its clients and leaves no goroutines behind.
+func TestCloseStopsGoroutines(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	sess := New("test-guid", &fakeStore{}, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+
+	conns := make([]*websocket.Conn, 0)
+	for i := 0; i < 3; i++ {
+		conns = append(conns, dial(t, server, fmt.Sprint(i)))
+	}
+
+	sess.Close()
+
+	// Every client gets disconnected.
+	for _, conn := range conns {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+		conn.Close()
+	}
+
+	// Clients can't join a closed session.
+	conn := dial(t, server, "late")
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Errorf("Read from a closed session, want an error")
+	}
+	conn.Close()
+
+	// Closing twice is harmless.
+	sess.Close()
+
+	server.Close()
+	waitForGoroutines(t, baseline)
+}
+
+// TestUnresponsiveClientReaped - a client that doesn't answer pings is disconnected and reported offline.
+func TestUnresponsiveClientReaped(t *testing.T) {
+	os.Setenv("PING_INTERVAL", "20ms")
+	os.Setenv("PONG_WAIT", "200ms")
+	defer os.Unsetenv("PING_INTERVAL")
+	defer os.Unsetenv("PONG_WAIT")
+
+	sess := New("test-guid", &fakeStore{}, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	// The observer keeps reading, which answers the pings.
+	observer := dial(t, server, "observer")
+	defer observer.Close()
+
+	// The silent client never reads, so it never answers.
+	silent := dial(t, server, "silent")
+	defer silent.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_ = observer.SetReadDeadline(deadline)
+		payload := model.Payload{}
+		if err := observer.ReadJSON(&payload); err != nil {
+			t.Fatalf("Error when reading %v, want an offline notification", err)
+		}
+		notification := payload.Notification
+		if notification != nil && notification.Client.UserID == "silent" && !notification.IsOnline {
+			return
+		}
+	}
+}
+
+// TestSlowClientOverflow - a client that never reads fills its own queue only, and is then disconnected or skipped
+// as SEND_OVERFLOW_POLICY says, while the others keep receiving.
+func TestSlowClientOverflow(t *testing.T) {
+	os.Setenv("SEND_QUEUE_SIZE", "4")
+	defer os.Unsetenv("SEND_QUEUE_SIZE")
+	os.Setenv("RATE_LIMIT_CONNECTION", "0")
+	defer os.Unsetenv("RATE_LIMIT_CONNECTION")
+
+	const numMessages = 10
+	for _, policy := range []string{OverflowDisconnect, OverflowDrop} {
+		os.Setenv("SEND_OVERFLOW_POLICY", policy)
+
+		sess := New("test-guid", &fakeStore{}, nil, presence.NewTracker(nil), nil, nil, nil)
+		server := newTestServer(sess)
+
+		// A connection without a wire has no writer, so nothing ever takes its frames from the queue.
+		slow := newQueuedConnection(nil, &model.Client{UserID: "slow", Username: "userslow"})
+		if !sess.addClient(slow) {
+			t.Fatalf("Couldn't add the slow client")
+		}
+		observer := dial(t, server, "observer")
+		sender := dial(t, server, "sender")
+
+		for i := 0; i < numMessages; i++ {
+			text := fmt.Sprint(i)
+			if ack := send(t, sender, text, text); !ack.OK {
+				t.Fatalf("Got ack %+v for %q, want it saved", ack, text)
+			}
+			if got := nextMessage(t, observer); got.Text != text {
+				t.Fatalf("Observer got %q with the %s policy, want %q", got.Text, policy, text)
+			}
+		}
+
+		closed := false
+		select {
+		case <-slow.closed:
+			closed = true
+		default:
+		}
+		switch policy {
+		case OverflowDisconnect:
+			if !closed {
+				t.Errorf("Slow client is connected with the %s policy, want it disconnected", policy)
+			}
+		case OverflowDrop:
+			if closed || len(slow.send) != cap(slow.send) {
+				t.Errorf("Slow client is closed %v with %v queued with the %s policy, want it connected with a full queue",
+					closed, len(slow.send), policy)
+			}
+			// The frames that fit are kept, the later ones are dropped.
+			for len(slow.send) > 0 {
+				out := <-slow.send
+				if len(out.payload.Messages) == 1 && out.payload.Messages[0].Text == fmt.Sprint(numMessages-1) {
+					t.Errorf("Slow client has the last message queued with the %s policy, want it dropped", policy)
+				}
+			}
+		}
+
+		observer.Close()
+		sender.Close()
+		server.Close()
+		sess.Close()
+	}
+	os.Unsetenv("SEND_OVERFLOW_POLICY")
+}
+
+// TestResumeReplaysMissedMessages - a reconnecting client gets the messages it missed, or is told to resync.
+func TestResumeReplaysMissedMessages(t *testing.T) {
+	os.Setenv("RESUME_MAX_MESSAGES", "3")
+	defer os.Unsetenv("RESUME_MAX_MESSAGES")
+
+	store := &fakeStore{}
+	for i := 0; i < 5; i++ {
+		if _, _, err := store.SaveMessage(model.Message{Text: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("Error when saving %v, want none", err)
+		}
+	}
+	sess := New("test-guid", store, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	tests := []struct {
+		lastSeq    int
+		wantSeqs   []int64
+		wantResync bool
+	}{
+		{lastSeq: 2, wantSeqs: []int64{5, 4, 3}},
+		{lastSeq: 5, wantSeqs: []int64{}},
+		{lastSeq: 1, wantResync: true},
+	}
+	for _, tt := range tests {
+		conn := dialQuery(t, server, fmt.Sprintf("user=resumer&lastSeq=%v", tt.lastSeq))
+		payload := model.Payload{}
+		if err := conn.ReadJSON(&payload); err != nil {
+			t.Fatalf("Error when reading %v, want none", err)
+		}
+		conn.Close()
+
+		if payload.Resync != tt.wantResync {
+			t.Errorf("Resync after %v is %v, want %v", tt.lastSeq, payload.Resync, tt.wantResync)
+		}
+		if tt.wantResync {
+			continue
+		}
+		seqs := make([]int64, 0)
+		for _, msg := range payload.Messages {
+			seqs = append(seqs, msg.Seq)
+		}
+		if fmt.Sprint(seqs) != fmt.Sprint(tt.wantSeqs) {
+			t.Errorf("Replayed %v after %v, want %v", seqs, tt.lastSeq, tt.wantSeqs)
+		}
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	os.Setenv("MAX_PAGE_SIZE", "50")
+	os.Setenv("DEFAULT_PAGE_SIZE", "20")
+	defer os.Unsetenv("MAX_PAGE_SIZE")
+	defer os.Unsetenv("DEFAULT_PAGE_SIZE")
+
+	tests := []struct {
+		requested int
+		want      int
+	}{
+		{0, 20},
+		{-3, 20},
+		{1, 1},
+		{30, 30},
+		{50, 50},
+		{51, 50},
+		{1000, 50},
+	}
+	for _, tt := range tests {
+		if got := pageSize(tt.requested); got != tt.want {
+			t.Errorf("Got page size %v for %v, want %v", got, tt.requested, tt.want)
+		}
+	}
+}
+
+// TestHistoryHasMore - a client pages through the history by its page token until no older messages are left.
+func TestHistoryHasMore(t *testing.T) {
+	store := &fakeStore{}
+	for i := 0; i < 5; i++ {
+		if _, _, err := store.SaveMessage(model.Message{Text: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("Error when saving %v, want none", err)
+		}
+	}
+	sess := New("test-guid", store, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	conn := dialQuery(t, server, "user=reader&pageSize=2")
+	defer conn.Close()
+	page := model.Payload{}
+	if err := conn.ReadJSON(&page); err != nil {
+		t.Fatalf("Error when reading %v, want none", err)
+	}
+
+	wantPages := []struct {
+		seqs    []int64
+		hasMore bool
+	}{
+		{[]int64{5, 4}, true},
+		{[]int64{3, 2}, true},
+		{[]int64{1}, false},
+	}
+	for i, want := range wantPages {
+		if i > 0 {
+			page = request(t, conn, &model.Payload{RequestID: fmt.Sprint(i), PageToken: page.PageToken, PageSize: 2})
+		}
+		seqs := make([]int64, 0)
+		for _, msg := range page.Messages {
+			seqs = append(seqs, msg.Seq)
+		}
+		if fmt.Sprint(seqs) != fmt.Sprint(want.seqs) || page.HasMore != want.hasMore {
+			t.Errorf("Page %v has %v and hasMore %v, want %v and %v", i, seqs, page.HasMore, want.seqs, want.hasMore)
+		}
+	}
+}
+
+// TestRangeHasMore - a range request tells whether more messages of the range are left than fit into the page.
+func TestRangeHasMore(t *testing.T) {
+	store := &fakeStore{}
+	for i := 0; i < 5; i++ {
+		if _, _, err := store.SaveMessage(model.Message{Text: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("Error when saving %v, want none", err)
+		}
+	}
+	sess := New("test-guid", store, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	conn := dial(t, server, "reader")
+	defer conn.Close()
+
+	tests := []struct {
+		from, to    int64
+		wantSeqs    []int64
+		wantHasMore bool
+	}{
+		{1, 5, []int64{2, 1}, true},
+		{3, 4, []int64{4, 3}, false},
+		{5, 9, []int64{5}, false},
+		{6, 9, []int64{}, false},
+	}
+	for i, tt := range tests {
+		page := request(t, conn, &model.Payload{RequestID: fmt.Sprint(i), SeqFrom: tt.from, SeqTo: tt.to, PageSize: 2})
+		seqs := make([]int64, 0)
+		for _, msg := range page.Messages {
+			seqs = append(seqs, msg.Seq)
+		}
+		if fmt.Sprint(seqs) != fmt.Sprint(tt.wantSeqs) || page.HasMore != tt.wantHasMore {
+			t.Errorf("Range %v-%v has %v and hasMore %v, want %v and %v", tt.from, tt.to, seqs, page.HasMore, tt.wantSeqs, tt.wantHasMore)
+		}
+	}
+}
+
+// request - will send the frame and return the response correlated with its request ID.
+func request(t *testing.T, conn *websocket.Conn, frame *model.Payload) model.Payload {
+	if err := conn.WriteJSON(frame); err != nil {
+		t.Fatalf("Error when writing %v, want none", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		payload := model.Payload{}
+		if err := conn.ReadJSON(&payload); err != nil {
+			t.Fatalf("Error when reading %v, want the response to %s", err, frame.RequestID)
+		}
+		if payload.RequestID == frame.RequestID && payload.Ack == nil {
+			return payload
+		}
+	}
+}
+
+// TestMessagesAcknowledged - every message frame is acked with the saved message, or nacked with a reason.
+func TestMessagesAcknowledged(t *testing.T) {
+	sess := New("test-guid", &fakeStore{}, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	conn := dial(t, server, "sender")
+	defer conn.Close()
+
+	tests := []struct {
+		frame string
+		want  model.Ack
+	}{
+		{
+			frame: `{"requestId": "1", "messages": [{"text": "hello"}]}`,
+			want:  model.Ack{RequestID: "1", OK: true, ID: 1, Seq: 1},
+		},
+		{
+			frame: `{"requestId": "2", "messages": [{"text": "` + strings.Repeat("a", 8001) + `"}]}`,
+			want:  model.Ack{RequestID: "2", Reason: model.ReasonTooLong},
+		},
+		{
+			frame: `{"requestId": "3", "messages": []}`,
+			want:  model.Ack{RequestID: "3", Reason: model.ReasonInvalid},
+		},
+		{
+			frame: `{"requestId": "4", "messages": [{"text": " \n\t "}]}`,
+			want:  model.Ack{RequestID: "4", Reason: model.ReasonEmpty},
+		},
+		{
+			frame: `{"requestId": "5", "messages": [{"text": "` + strings.Repeat("é", 8000) + `"}]}`,
+			want:  model.Ack{RequestID: "5", OK: true, ID: 2, Seq: 2},
+		},
+		{
+			frame: `{"requestId": "6", "messages": [`,
+			want:  model.Ack{Reason: model.ReasonInvalid},
+		},
+	}
+	for _, tt := range tests {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.frame)); err != nil {
+			t.Fatalf("Error when writing %v, want none", err)
+		}
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			payload := model.Payload{}
+			if err := conn.ReadJSON(&payload); err != nil {
+				t.Fatalf("Error when reading %v, want an ack", err)
+			}
+			if payload.Ack == nil {
+				continue
+			}
+			ack := *payload.Ack
+			ack.Details = ""
+			if ack != tt.want {
+				t.Errorf("Ack %+v, want %+v", *payload.Ack, tt.want)
+			}
+			break
+		}
+	}
+}
+
+// TestResendDeduplicated - a message resent with the same client message ID is acked as the original
+// and echoed back to the sender only, without being saved or broadcast again.
+func TestResendDeduplicated(t *testing.T) {
+	store := &fakeStore{}
+	sess := New("test-guid", store, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	observer := dial(t, server, "observer")
+	defer observer.Close()
+	sender := dial(t, server, "sender")
+	defer sender.Close()
+
+	original := sendMessage(t, sender, "1", model.Message{Text: "hello", ClientMsgID: "c1"})
+	if !original.OK {
+		t.Fatalf("Got ack %+v, want the message accepted", original)
+	}
+	nextMessage(t, sender)
+	nextMessage(t, observer)
+
+	resent := sendMessage(t, sender, "2", model.Message{Text: "hello", ClientMsgID: "c1"})
+	if !resent.OK || resent.ID != original.ID || resent.Seq != original.Seq {
+		t.Errorf("Got ack %+v for the resend, want the ID %v and seq %v of the original", resent, original.ID, original.Seq)
+	}
+	if echo := nextMessage(t, sender); echo.ID != original.ID || echo.ClientMsgID != "c1" {
+		t.Errorf("Got %+v echoed, want the original", echo)
+	}
+
+	// Whatever is delivered next follows the resend, so a broadcast resend would arrive first.
+	if next := sendMessage(t, sender, "3", model.Message{Text: "next", ClientMsgID: "c2"}); !next.OK {
+		t.Fatalf("Got ack %+v, want the message accepted", next)
+	}
+	for _, conn := range []*websocket.Conn{observer, sender} {
+		if got := nextMessage(t, conn); got.Text != "next" {
+			t.Errorf("Got %+v, want the message sent after the resend", got)
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.msgs) != 2 {
+		t.Errorf("Saved %v messages, want 2", len(store.msgs))
+	}
+}
+
+// TestFrameSizeLimited - a frame over MAX_FRAME_SIZE closes the connection.
+func TestFrameSizeLimited(t *testing.T) {
+	os.Setenv("MAX_FRAME_SIZE", "1024")
+	defer os.Unsetenv("MAX_FRAME_SIZE")
+
+	sess := New("test-guid", &fakeStore{}, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	conn := dial(t, server, "sender")
+	defer conn.Close()
+
+	payload := model.Payload{Messages: []model.Message{{Text: strings.Repeat("a", 2048)}}}
+	if err := conn.WriteJSON(&payload); err != nil {
+		t.Fatalf("Error when writing %v, want none", err)
+	}
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("Error when reading %v, want the connection closed as too big", err)
+		}
+	}
+}
+
+// TestTypedProtocol - a client that negotiates the typed protocol exchanges typed, versioned envelopes.
+func TestTypedProtocol(t *testing.T) {
+	sess := New("test-guid", &fakeStore{}, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"chat.v1"}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?user=typed", nil)
+	if err != nil {
+		t.Fatalf("Error when dialing %v, want none", err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "chat.v1" {
+		t.Fatalf("Negotiated protocol [%s], want [chat.v1]", conn.Subprotocol())
+	}
+
+	envelope := model.Envelope{}
+	if err := conn.ReadJSON(&envelope); err != nil {
+		t.Fatalf("Error when reading %v, want none", err)
+	}
+	if envelope.Version != 1 || envelope.Type != model.TypeHistory {
+		t.Errorf("First frame is version %v of type [%s], want version 1 of type [%s]", envelope.Version, envelope.Type, model.TypeHistory)
+	}
+
+	tests := []struct {
+		frame string
+		want  model.Ack
+	}{
+		{
+			frame: `{"version": 1, "type": "message", "requestId": "1", "messages": [{"text": "hello"}]}`,
+			want:  model.Ack{RequestID: "1", OK: true, ID: 1, Seq: 1},
+		},
+		{
+			frame: `{"version": 1, "type": "bogus", "requestId": "2"}`,
+			want:  model.Ack{RequestID: "2", Reason: model.ReasonInvalid},
+		},
+		{
+			frame: `{"requestId": "3", "messages": [{"text": "untyped"}]}`,
+			want:  model.Ack{RequestID: "3", Reason: model.ReasonInvalid},
+		},
+	}
+	for _, tt := range tests {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.frame)); err != nil {
+			t.Fatalf("Error when writing %v, want none", err)
+		}
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			envelope := model.Envelope{}
+			if err := conn.ReadJSON(&envelope); err != nil {
+				t.Fatalf("Error when reading %v, want an ack", err)
+			}
+			if envelope.Type != model.TypeAck {
+				continue
+			}
+			ack := *envelope.Ack
+			ack.Details = ""
+			if ack != tt.want {
+				t.Errorf("Ack %+v, want %+v", *envelope.Ack, tt.want)
+			}
+			break
+		}
+	}
+}
+
+// TestBinaryProtocol - a client that negotiates MessagePack exchanges binary frames with the same schema.
+func TestBinaryProtocol(t *testing.T) {
+	sess := New("test-guid", &fakeStore{}, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"chat.v1.msgpack"}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?user=binary", nil)
+	if err != nil {
+		t.Fatalf("Error when dialing %v, want none", err)
+	}
+	defer conn.Close()
+
+	codec := msgpackCodec{}
+	read := func() model.Envelope {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Error when reading %v, want none", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Fatalf("Read message of type %v, want binary", messageType)
+		}
+		envelope := model.Envelope{}
+		if err := codec.unmarshal(data, &envelope); err != nil {
+			t.Fatalf("Error when decoding %v, want none", err)
+		}
+		return envelope
+	}
+
+	if envelope := read(); envelope.Type != model.TypeHistory {
+		t.Errorf("First frame is of type [%s], want [%s]", envelope.Type, model.TypeHistory)
+	}
+
+	sent := model.Envelope{Version: 1, Type: model.TypeMessage, Payload: model.Payload{
+		RequestID: "1",
+		Messages:  []model.Message{{Text: "hello"}},
+	}}
+	data, err := codec.marshal(&sent)
+	if err != nil {
+		t.Fatalf("Error when encoding %v, want none", err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, data); err != nil {
+		t.Fatalf("Error when writing %v, want none", err)
+	}
+
+	gotAck, gotMessage := false, false
+	for !gotAck || !gotMessage {
+		envelope := read()
+		switch envelope.Type {
+		case model.TypeAck:
+			gotAck = true
+			if !envelope.Ack.OK || envelope.Ack.RequestID != "1" {
+				t.Errorf("Ack %+v, want a positive ack of request 1", *envelope.Ack)
+			}
+		case model.TypeMessage:
+			gotMessage = true
+			if len(envelope.Messages) != 1 || envelope.Messages[0].Text != "hello" {
+				t.Errorf("Broadcast %v, want the message sent", envelope.Messages)
+			}
+		}
+	}
+}
+
+// TestGoAway - clients of a session closed because the server goes away are told to reconnect.
+func TestGoAway(t *testing.T) {
+	sess := New("test-guid", &fakeStore{}, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+
+	conn := dial(t, server, "leaver")
+	defer conn.Close()
+
+	sess.GoAway()
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("Error when reading %v, want the connection closed as going away", err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package session
+
+import (
+	log "gitlab.starlink.ua/high-school-prod/chat/logger"
+	"gitlab.starlink.ua/high-school-prod/chat/server/config"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"time"
+)
+
+// typingState - a user that is typing, as last relayed to the other clients.
+type typingState struct {
+	client      model.Client
+	lastRelayed time.Time
+	expiry      *time.Timer
+}
+
+// setTyping - will relay to the other clients that the user started or stopped typing. Typing indicators aren't saved.
+// Repeated "typing" frames are relayed at most once per TYPING_THROTTLE, and a user who sends none
+// for TYPING_TIMEOUT is considered to have stopped typing.
+func (session *Session) setTyping(client model.Client, isTyping bool) {
+	session.typingMu.Lock()
+	state, wasTyping := session.typing[client.UserID]
+
+	if !isTyping {
+		if !wasTyping {
+			session.typingMu.Unlock()
+			return
+		}
+		state.expiry.Stop()
+		delete(session.typing, client.UserID)
+		session.typingMu.Unlock()
+
+		session.sendTypingNotification(client, false)
+		return
+	}
+
+	timeout := config.Duration("TYPING_TIMEOUT", 5*time.Second)
+	if wasTyping {
+		state.expiry.Reset(timeout)
+		if time.Since(state.lastRelayed) < config.Duration("TYPING_THROTTLE", 2*time.Second) {
+			session.typingMu.Unlock()
+			return
+		}
+	} else {
+		state = &typingState{client: client}
+		state.expiry = time.AfterFunc(timeout, func() {
+			session.expireTyping(state)
+		})
+		session.typing[client.UserID] = state
+	}
+	state.lastRelayed = time.Now()
+	session.typingMu.Unlock()
+
+	session.sendTypingNotification(client, true)
+}
+
+// expireTyping - will stop the typing indicator of a user who went quiet.
+func (session *Session) expireTyping(state *typingState) {
+	session.typingMu.Lock()
+	if session.typing[state.client.UserID] != state {
+		session.typingMu.Unlock()
+		return
+	}
+	delete(session.typing, state.client.UserID)
+	session.typingMu.Unlock()
+
+	log.Logger.Infof("Client [%s] stopped typing without saying so", state.client)
+	session.sendTypingNotification(state.client, false)
+}
+
+// stopTyping - will cancel the expiry of all typing indicators.
+func (session *Session) stopTyping() {
+	session.typingMu.Lock()
+	defer session.typingMu.Unlock()
+	for userID, state := range session.typing {
+		state.expiry.Stop()
+		delete(session.typing, userID)
+	}
+}
+
+// sendTypingNotification will send a notification to all other clients when a user starts or stops typing.
+func (session *Session) sendTypingNotification(user model.Client, isTyping bool) {
+	payload := &model.Payload{
+		Typing: &model.TypingNotification{
+			Client:   &user,
+			IsTyping: isTyping,
+		},
+	}
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	for conn, client := range session.clients {
+		// Avoid sending notifications to ourselves.
+		if client.UserID != user.UserID {
+			conn.enqueue(model.TypeTyping, payload)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package session
+
+import (
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"gitlab.starlink.ua/high-school-prod/chat/server/presence"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestTypingRelayedAndExpired - a typing indicator reaches the others once and expires when the typer goes quiet.
+func TestTypingRelayedAndExpired(t *testing.T) {
+	os.Setenv("TYPING_TIMEOUT", "100ms")
+	defer os.Unsetenv("TYPING_TIMEOUT")
+
+	sess := New("test-guid", &fakeStore{}, nil, presence.NewTracker(nil), nil, nil, nil)
+	server := newTestServer(sess)
+	defer server.Close()
+	defer sess.Close()
+
+	observer := dial(t, server, "observer")
+	defer observer.Close()
+	typer := dial(t, server, "typer")
+	defer typer.Close()
+
+	// Repeated frames within the throttle interval are relayed once.
+	for i := 0; i < 3; i++ {
+		if err := typer.WriteJSON(&model.Payload{Typing: &model.TypingNotification{IsTyping: true}}); err != nil {
+			t.Fatalf("Error when writing %v, want none", err)
+		}
+	}
+
+	indicators := make([]bool, 0)
+	_ = observer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(indicators) < 2 {
+		payload := model.Payload{}
+		if err := observer.ReadJSON(&payload); err != nil {
+			t.Fatalf("Error when reading %v, want typing indicators", err)
+		}
+		if payload.Typing != nil {
+			if payload.Typing.Client.UserID != "typer" {
+				t.Errorf("Typing indicator of [%s], want typer", payload.Typing.Client)
+			}
+			indicators = append(indicators, payload.Typing.IsTyping)
+		}
+	}
+
+	if !indicators[0] || indicators[1] {
+		t.Errorf("Got typing indicators %v, want [true false]", indicators)
+	}
+}
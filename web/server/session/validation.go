@@ -0,0 +1,80 @@
+package session
+
+import (
+	"fmt"
+	"gitlab.starlink.ua/high-school-prod/chat/server/config"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxClientMsgIDLength - the maximum length of an idempotency key generated by a client.
+const maxClientMsgIDLength = 64
+
+// malformedError - a frame that couldn't be decoded into a payload. The connection survives it.
+type malformedError struct {
+	err error
+}
+
+func (e *malformedError) Error() string {
+	return fmt.Sprintf("malformed frame - %s", e.err)
+}
+
+// maxFrameSize - the largest frame a client may send, MAX_FRAME_SIZE bytes.
+// A larger frame closes the connection before it's read in full.
+func maxFrameSize() int64 {
+	return int64(config.Int("MAX_FRAME_SIZE", 64*1024))
+}
+
+// validationError - the reason a message frame is rejected for, with the details for the client.
+type validationError struct {
+	reason  string
+	details string
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("%s - %s", e.reason, e.details)
+}
+
+// validateMessage - will check the message frame a client sent and return its message with the text normalized.
+// A frame must carry exactly one message, whose text is valid UTF-8, not blank after normalization,
+// and no longer than MAX_MESSAGE_LENGTH characters.
+func validateMessage(payload *model.Payload) (model.Message, *validationError) {
+	if len(payload.Messages) != 1 {
+		return model.Message{}, &validationError{model.ReasonInvalid, fmt.Sprintf("%v messages in a frame, want 1", len(payload.Messages))}
+	}
+	msg := payload.Messages[0]
+
+	if len(msg.ClientMsgID) > maxClientMsgIDLength {
+		return msg, &validationError{model.ReasonInvalid, fmt.Sprintf("client message ID longer than %v", maxClientMsgIDLength)}
+	}
+	if !utf8.ValidString(msg.Text) {
+		return msg, &validationError{model.ReasonInvalid, "text is not valid UTF-8"}
+	}
+
+	msg.Text = normalizeText(msg.Text)
+	if msg.Text == "" {
+		return msg, &validationError{model.ReasonEmpty, "text is blank"}
+	}
+	maxLength := config.Int("MAX_MESSAGE_LENGTH", 8000)
+	if length := utf8.RuneCountInString(msg.Text); length > maxLength {
+		return msg, &validationError{model.ReasonTooLong, fmt.Sprintf("%v characters, want at most %v", length, maxLength)}
+	}
+
+	return msg, nil
+}
+
+// normalizeText - will unify line breaks, drop control characters other than line breaks and tabs,
+// and trim the surrounding whitespace.
+func normalizeText(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	text = strings.Map(func(r rune) rune {
+		if r != '\n' && r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+	return strings.TrimSpace(text)
+}
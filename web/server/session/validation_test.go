@@ -0,0 +1,34 @@
+package session
+
+import (
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"testing"
+)
+
+func TestValidateMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		messages   []model.Message
+		wantText   string
+		wantReason string
+	}{
+		{name: "normalized", messages: []model.Message{{Text: "  hi\r\nthere\x00\t "}}, wantText: "hi\nthere"},
+		{name: "no messages", messages: nil, wantReason: model.ReasonInvalid},
+		{name: "two messages", messages: []model.Message{{Text: "a"}, {Text: "b"}}, wantReason: model.ReasonInvalid},
+		{name: "invalid UTF-8", messages: []model.Message{{Text: "\xff"}}, wantReason: model.ReasonInvalid},
+		{name: "blank", messages: []model.Message{{Text: "\r\n \x07"}}, wantReason: model.ReasonEmpty},
+	}
+	for _, tt := range tests {
+		msg, err := validateMessage(&model.Payload{Messages: tt.messages})
+		reason := ""
+		if err != nil {
+			reason = err.reason
+		}
+		if reason != tt.wantReason {
+			t.Errorf("%s: reason %q, want %q", tt.name, reason, tt.wantReason)
+		}
+		if err == nil && msg.Text != tt.wantText {
+			t.Errorf("%s: text %q, want %q", tt.name, msg.Text, tt.wantText)
+		}
+	}
+}
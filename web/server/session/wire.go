@@ -0,0 +1,115 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gitlab.starlink.ua/high-school-prod/chat/server/model"
+	"net/http"
+	"time"
+)
+
+// wire - the transport a connection's frames are written to. Only the connection's writer writes to it.
+type wire interface {
+	// write - will write a frame of the given type.
+	write(frameType string, payload *model.Payload) error
+	// ping - will show the client, and the proxies in between, that the connection is alive.
+	ping() error
+	// goodbye - will tell the client that the connection is being closed, and why.
+	goodbye(code int, text string) error
+	// close - will release the transport. Unlike the rest, it may be called while the writer is writing.
+	close() error
+}
+
+// wsWire - a WebSocket, speaking the protocol the client negotiated.
+type wsWire struct {
+	conn      *websocket.Conn
+	protocol  protocol
+	writeWait time.Duration
+}
+
+// write - will wrap the payload into the envelope of the client's protocol version, encode and write it.
+// Clients of the untyped protocol get the bare payload.
+func (w *wsWire) write(frameType string, payload *model.Payload) error {
+	var frame interface{} = payload
+	if w.protocol.version > 0 {
+		frame = &model.Envelope{Version: w.protocol.version, Type: frameType, Payload: *payload}
+	}
+	data, err := w.protocol.codec.marshal(frame)
+	if err != nil {
+		return err
+	}
+	if err := w.conn.SetWriteDeadline(time.Now().Add(w.writeWait)); err != nil {
+		return err
+	}
+	return w.conn.WriteMessage(w.protocol.codec.messageType(), data)
+}
+
+func (w *wsWire) ping() error {
+	return w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(w.writeWait))
+}
+
+func (w *wsWire) goodbye(code int, text string) error {
+	message := websocket.FormatCloseMessage(code, text)
+	return w.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(w.writeWait))
+}
+
+func (w *wsWire) close() error {
+	return w.conn.Close()
+}
+
+// sseWire - a stream of Server-Sent Events. Every frame is an event named after its type, carrying the JSON envelope
+// of the latest typed protocol. Frames with messages carry the newest sequence number as the event ID.
+type sseWire struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (w *sseWire) write(frameType string, payload *model.Payload) error {
+	frame := envelope(frameType, payload)
+	data, err := json.Marshal(&frame)
+	if err != nil {
+		return err
+	}
+
+	var event bytes.Buffer
+	var lastSeq int64
+	for _, msg := range payload.Messages {
+		if msg.Seq > lastSeq {
+			lastSeq = msg.Seq
+		}
+	}
+	if lastSeq > 0 {
+		fmt.Fprintf(&event, "id: %v\n", lastSeq)
+	}
+	fmt.Fprintf(&event, "event: %s\ndata: %s\n\n", frameType, data)
+	return w.send(event.Bytes())
+}
+
+// ping - will send a comment, which clients ignore.
+func (w *sseWire) ping() error {
+	return w.send([]byte(": ping\n\n"))
+}
+
+func (w *sseWire) goodbye(code int, text string) error {
+	data, err := json.Marshal(map[string]interface{}{"code": code, "reason": text})
+	if err != nil {
+		return err
+	}
+	return w.send([]byte(fmt.Sprintf("event: close\ndata: %s\n\n", data)))
+}
+
+// close - does nothing, the stream ends when its handler returns.
+func (w *sseWire) close() error {
+	return nil
+}
+
+// send - will write the bytes and flush them to the client right away.
+func (w *sseWire) send(data []byte) error {
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	w.flusher.Flush()
+	return nil
+}